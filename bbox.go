@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/codesoap/pbf-reblob/pbfio"
+	"github.com/codesoap/pbf-reblob/pbfproto"
+)
+
+// computeBBox reads all data blobs of cfg.inFile and returns the
+// bounding box of all locations found in them. If keeps is not nil, only
+// the entities for which it returns true are considered. If there are no
+// locations, nil is returned.
+func computeBBox(cfg config, keeps func(e *pbfio.Entity) bool) (*pbfproto.HeaderBBox, error) {
+	blobs := make(chan pbfio.DecodedBlob)
+	// Problems are reported by the second pass, so Warn is not set.
+	go pbfio.StreamBlobs(cfg.inFile, pbfio.ReaderOptions{Resync: cfg.resync}, blobs)
+	var bbox pbfio.BBox
+	found := false
+	var err error
+	for blob := range blobs {
+		if err != nil {
+			// Drain blobs, so that StreamBlobs can finish.
+			continue
+		} else if blob.Err != nil {
+			err = fmt.Errorf("could not read blob: %v", blob.Err)
+			continue
+		} else if blob.PrimitiveBlock == nil {
+			continue
+		}
+		block := blob.PrimitiveBlock
+		if keeps != nil {
+			block, err = filterBlock(block, keeps)
+		}
+		if err != nil {
+			err = fmt.Errorf("%s: %v", blob.Position(), err)
+		} else if block == nil {
+			// No entity of the block is kept.
+		} else if extent, ok := pbfio.Extent(block); ok && found {
+			bbox = bbox.Union(extent)
+		} else if ok {
+			bbox, found = extent, true
+		}
+		blob.PrimitiveBlock.ReturnToVTPool()
+	}
+	if err != nil || !found {
+		return nil, err
+	}
+	return &pbfproto.HeaderBBox{
+		Left:   &bbox.Left,
+		Right:  &bbox.Right,
+		Top:    &bbox.Top,
+		Bottom: &bbox.Bottom,
+	}, nil
+}
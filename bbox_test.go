@@ -0,0 +1,52 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/codesoap/pbf-reblob/pbfio"
+	"github.com/codesoap/pbf-reblob/pbfproto"
+)
+
+func TestRecomputeBBox(t *testing.T) {
+	expr, err := parseFilterExpr("highway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, filter := range []entityFilter{{}, {exprs: []filterExpr{expr}, references: true}} {
+		cfg := config{
+			maxBlobSize:   1 << 20,
+			jobs:          1,
+			recomputeBBox: true,
+			entityFilter:  filter,
+			inFile:        writeTestFile(t, filterTestBlock()),
+			outFile:       filepath.Join(t.TempDir(), "out.osm.pbf"),
+			compression:   "zlib",
+		}
+		reblob(cfg)
+
+		blobs := make(chan pbfio.DecodedBlob)
+		go pbfio.StreamBlobs(cfg.outFile, pbfio.ReaderOptions{}, blobs)
+		var header *pbfproto.HeaderBBox
+		var want pbfio.BBox
+		found := false
+		for blob := range blobs {
+			if blob.Err != nil {
+				t.Fatal(blob.Err)
+			} else if blob.HeaderBlock != nil {
+				header = blob.HeaderBlock.Bbox
+			} else if extent, ok := pbfio.Extent(blob.PrimitiveBlock); ok && found {
+				want = want.Union(extent)
+			} else if ok {
+				want, found = extent, true
+			}
+		}
+		if !found {
+			t.Fatalf("filter %v: no locations were written", filter.exprs)
+		}
+		if header == nil || header.GetLeft() != want.Left || header.GetRight() != want.Right ||
+			header.GetTop() != want.Top || header.GetBottom() != want.Bottom {
+			t.Errorf("filter %v: got bounding box %v, want %+v", filter.exprs, header, want)
+		}
+	}
+}
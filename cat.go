@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codesoap/pbf-reblob/pbfio"
+	"github.com/codesoap/pbf-reblob/pbfproto"
+)
+
+func runCat(args []string) {
+	flags := flag.NewFlagSet("cat", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:\n  pbf-reblob cat [<OPTIONS>] <IN_FILE>")
+		fmt.Fprintln(os.Stderr, "The entities of IN_FILE are written to stdout.")
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+	}
+	format := flags.String("format", "xml", "output format; only 'xml' is supported")
+	blobRange := flags.String("blobs", "", "only output the blobs with these indexes, e.g. '5', '3-7' or '3-'; the OSMHeader has index 0")
+	resync := flags.Bool("r", false, "skip damaged regions of the input file instead of aborting")
+	flags.Parse(args)
+	if flags.NArg() != 1 || *format != "xml" {
+		flags.Usage()
+		os.Exit(1)
+	}
+	from, to, err := parseBlobRange(*blobRange)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	} else if *blobRange != "" && *resync {
+		// After a skipped damaged region, the indexes of the following
+		// blobs are unknown.
+		fmt.Fprintln(os.Stderr, "Error: -r cannot be combined with -blobs.")
+		os.Exit(1)
+	}
+	inFile := flags.Arg(0)
+	blobs := make(chan pbfio.DecodedBlob)
+	if *blobRange == "" {
+		opts := pbfio.ReaderOptions{
+			Resync: *resync,
+			Warn: func(err error) {
+				fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			},
+		}
+		go pbfio.StreamBlobs(inFile, opts, blobs)
+	} else {
+		go readBlobRange(inFile, from, to, blobs)
+	}
+	w := bufio.NewWriter(os.Stdout)
+	if err = writeXML(w, blobs); err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Could not write XML: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// parseBlobRange parses ranges like '5', '3-7', '3-' or '-7'. If s is
+// empty, all indexes are included.
+func parseBlobRange(s string) (from, to int, err error) {
+	from, to = 0, math.MaxInt
+	if s == "" {
+		return from, to, nil
+	}
+	first, last, isRange := strings.Cut(s, "-")
+	if first != "" {
+		if from, err = strconv.Atoi(first); err != nil || from < 0 {
+			return 0, 0, fmt.Errorf("invalid blob range '%s'", s)
+		}
+	}
+	if !isRange {
+		return from, from, nil
+	} else if last != "" {
+		if to, err = strconv.Atoi(last); err != nil || to < from {
+			return 0, 0, fmt.Errorf("invalid blob range '%s'", s)
+		}
+	}
+	return from, to, nil
+}
+
+// readBlobRange sends the blobs of inFile with indexes from from to to,
+// inclusively, to blobs. Only the framing of the blobs before them is
+// read. blobs is closed afterwards.
+func readBlobRange(inFile string, from, to int, blobs chan pbfio.DecodedBlob) {
+	defer close(blobs)
+	file, err := os.Open(inFile)
+	if err != nil {
+		blobs <- pbfio.DecodedBlob{Err: fmt.Errorf("could not open in file '%s': %v", inFile, err)}
+		return
+	}
+	defer file.Close()
+	scanner := pbfio.NewBlobScanner(file)
+	reader := pbfio.NewBlobReader(file)
+	defer reader.Close()
+	for {
+		info, err := scanner.Next()
+		if err == io.EOF || err == nil && info.Index > to {
+			return
+		} else if err != nil {
+			blobs <- pbfio.DecodedBlob{Err: err}
+			return
+		} else if info.Index < from {
+			continue
+		}
+		blob, err := reader.ReadBlob(info.Offset)
+		if err != nil {
+			blobs <- pbfio.DecodedBlob{Err: err}
+			return
+		}
+		blob.Index = info.Index
+		blobs <- blob
+	}
+}
+
+// writeXML writes the entities of blobs as OSM XML to w. The bounding
+// box of the OSMHeader is written, if it is among blobs.
+func writeXML(w *bufio.Writer, blobs chan pbfio.DecodedBlob) error {
+	defer func() {
+		// Drain blobs, so that the reader can finish.
+		for range blobs {
+		}
+	}()
+	w.WriteString("<?xml version='1.0' encoding='UTF-8'?>\n")
+	w.WriteString("<osm version=\"0.6\" generator=\"pbf-reblob\">\n")
+	for blob := range blobs {
+		if blob.Err != nil {
+			return fmt.Errorf("could not read blob: %v", blob.Err)
+		} else if blob.HeaderBlock != nil {
+			writeBounds(w, blob.HeaderBlock.Bbox)
+			continue
+		} else if blob.PrimitiveBlock == nil {
+			continue
+		}
+		entities, err := pbfio.Entities(blob.PrimitiveBlock)
+		if err != nil {
+			return fmt.Errorf("%s: %v", blob.Position(), err)
+		}
+		for i := range entities {
+			writeEntity(w, &entities[i])
+		}
+		// The entities may refer to the block, so it is only returned
+		// after they have been written.
+		blob.PrimitiveBlock.ReturnToVTPool()
+	}
+	_, err := w.WriteString("</osm>\n")
+	return err
+}
+
+func writeBounds(w *bufio.Writer, bbox *pbfproto.HeaderBBox) {
+	if bbox == nil {
+		return
+	}
+	fmt.Fprintf(w, "  <bounds minlat=\"%s\" minlon=\"%s\" maxlat=\"%s\" maxlon=\"%s\"/>\n",
+		formatDegrees(bbox.GetBottom()), formatDegrees(bbox.GetLeft()),
+		formatDegrees(bbox.GetTop()), formatDegrees(bbox.GetRight()))
+}
+
+func writeEntity(w *bufio.Writer, e *pbfio.Entity) {
+	fmt.Fprintf(w, "  <%s id=\"%d\"", e.Type, e.ID)
+	if info := e.Info; info != nil {
+		fmt.Fprintf(w, " version=\"%d\" timestamp=\"%s\" changeset=\"%d\"",
+			info.Version, time.UnixMilli(info.Timestamp).UTC().Format(time.RFC3339), info.Changeset)
+		if info.UID != 0 || info.User != "" {
+			fmt.Fprintf(w, " uid=\"%d\" user=\"", info.UID)
+			xml.EscapeText(w, []byte(info.User))
+			w.WriteByte('"')
+		}
+		if info.Visible != nil {
+			fmt.Fprintf(w, " visible=\"%t\"", *info.Visible)
+		}
+	}
+	// Deleted nodes have no location.
+	if e.Type == pbfio.NodeType && (e.Info == nil || e.Info.Visible == nil || *e.Info.Visible) {
+		fmt.Fprintf(w, " lat=\"%s\" lon=\"%s\"", formatDegrees(e.Lat), formatDegrees(e.Lon))
+	}
+	if len(e.Tags) == 0 && len(e.Refs) == 0 && len(e.Members) == 0 {
+		w.WriteString("/>\n")
+		return
+	}
+	w.WriteString(">\n")
+	for i, ref := range e.Refs {
+		fmt.Fprintf(w, "    <nd ref=\"%d\"", ref)
+		if i < len(e.RefLats) && knownLocation(e.RefLats[i]) {
+			fmt.Fprintf(w, " lat=\"%s\" lon=\"%s\"", formatDegrees(e.RefLats[i]), formatDegrees(e.RefLons[i]))
+		}
+		w.WriteString("/>\n")
+	}
+	for _, member := range e.Members {
+		fmt.Fprintf(w, "    <member type=\"%s\" ref=\"%d\" role=\"", member.Type, member.ID)
+		xml.EscapeText(w, []byte(member.Role))
+		w.WriteString("\"/>\n")
+	}
+	for _, tag := range e.Tags {
+		w.WriteString("    <tag k=\"")
+		xml.EscapeText(w, []byte(tag.Key))
+		w.WriteString("\" v=\"")
+		xml.EscapeText(w, []byte(tag.Value))
+		w.WriteString("\"/>\n")
+	}
+	fmt.Fprintf(w, "  </%s>\n", e.Type)
+}
+
+// formatDegrees formats a coordinate given in nanodegrees as degrees
+// without trailing zeros and without rounding errors.
+func formatDegrees(nano int64) string {
+	sign := ""
+	if nano < 0 {
+		sign, nano = "-", -nano
+	}
+	frac := strings.TrimRight(fmt.Sprintf("%09d", nano%1e9), "0")
+	if frac == "" {
+		return fmt.Sprintf("%s%d", sign, nano/1e9)
+	}
+	return fmt.Sprintf("%s%d.%s", sign, nano/1e9, frac)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/codesoap/pbf-reblob/pbfio"
+	"github.com/codesoap/pbf-reblob/pbfproto"
+)
+
+func TestWriteEntity(t *testing.T) {
+	visible := false
+	tests := []struct {
+		entity pbfio.Entity
+		want   string
+	}{
+		{
+			pbfio.Entity{Type: pbfio.NodeType, ID: 1, Lat: -1500000000, Lon: 13400000},
+			`  <node id="1" lat="-1.5" lon="0.0134"/>` + "\n",
+		},
+		{
+			pbfio.Entity{Type: pbfio.NodeType, ID: 2, Info: &pbfio.Info{
+				Version: 3, Timestamp: 1700000000000, Changeset: 7, UID: 5, User: `a&"b"`, Visible: &visible,
+			}},
+			`  <node id="2" version="3" timestamp="2023-11-14T22:13:20Z" changeset="7" uid="5" user="a&amp;&#34;b&#34;" visible="false"/>` + "\n",
+		},
+		{
+			pbfio.Entity{Type: pbfio.WayType, ID: 3, Refs: []int64{1, 2}, Tags: []pbfio.Tag{{Key: "name", Value: "<x>"}}},
+			`  <way id="3">
+    <nd ref="1"/>
+    <nd ref="2"/>
+    <tag k="name" v="&lt;x&gt;"/>
+  </way>
+`,
+		},
+		{
+			pbfio.Entity{Type: pbfio.RelationType, ID: 4, Members: []pbfio.Member{{Type: pbfio.WayType, ID: 3, Role: "outer"}}},
+			`  <relation id="4">
+    <member type="way" ref="3" role="outer"/>
+  </relation>
+`,
+		},
+	}
+	for _, test := range tests {
+		var sb strings.Builder
+		w := bufio.NewWriter(&sb)
+		writeEntity(w, &test.entity)
+		w.Flush()
+		if sb.String() != test.want {
+			t.Errorf("got\n%s\nwant\n%s", sb.String(), test.want)
+		}
+	}
+}
+
+func TestParseBlobRange(t *testing.T) {
+	tests := []struct {
+		s        string
+		from, to int
+	}{
+		{"5", 5, 5},
+		{"3-7", 3, 7},
+		{"-7", 0, 7},
+	}
+	for _, test := range tests {
+		from, to, err := parseBlobRange(test.s)
+		if err != nil || from != test.from || to != test.to {
+			t.Errorf("%s: got %d-%d, %v", test.s, from, to, err)
+		}
+	}
+	for _, s := range []string{"a", "7-3", "-1-2"} {
+		if _, _, err := parseBlobRange(s); err == nil {
+			t.Errorf("%s: expected error", s)
+		}
+	}
+}
+
+func TestWriteXMLVisible(t *testing.T) {
+	// Blocks of deleted and visible nodes alternate, so that reused
+	// blocks would overwrite the flags of earlier ones.
+	var blocks []*pbfproto.PrimitiveBlock
+	for i := range 20 {
+		visible := i%2 == 1
+		var b pbfio.BlockBuilder
+		b.Add(&pbfio.Entity{Type: pbfio.NodeType, ID: int64(i), Info: &pbfio.Info{Version: 1, Visible: &visible}})
+		blocks = append(blocks, b.Build())
+	}
+	blobs := make(chan pbfio.DecodedBlob)
+	go pbfio.StreamBlobs(writeTestFile(t, blocks...), pbfio.ReaderOptions{}, blobs)
+	var sb strings.Builder
+	w := bufio.NewWriter(&sb)
+	if err := writeXML(w, blobs); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+	for i, line := range strings.Split(sb.String(), "\n")[2:22] {
+		if want := fmt.Sprintf(`visible="%t"`, i%2 == 1); !strings.Contains(line, want) {
+			t.Errorf("node %d is written as %s; want %s", i, line, want)
+		}
+	}
+}
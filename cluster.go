@@ -0,0 +1,49 @@
+package main
+
+import "github.com/codesoap/pbf-reblob/pbfio"
+
+// clusterBits is the amount of bits per axis of the cells of the
+// Hilbert curve, that is used for clustering. With 16 bits, cells are
+// about 600m wide and 300m high at the equator.
+const clusterBits = 16
+
+// clusterCell returns the cell of the Hilbert curve, that e is located
+// in. Ways are located at their first node, if ways is set and their
+// node locations are known; otherwise they are in cell 0, like
+// relations.
+func clusterCell(e *pbfio.Entity, ways bool) uint64 {
+	switch {
+	case e.Type == pbfio.NodeType:
+		return hilbertCell(e.Lat, e.Lon)
+	case e.Type == pbfio.WayType && ways && len(e.RefLats) > 0:
+		return hilbertCell(e.RefLats[0], e.RefLons[0])
+	}
+	return 0
+}
+
+// hilbertCell returns the position of the cell containing the location
+// on the Hilbert curve. Locations are given in nanodegrees.
+func hilbertCell(lat, lon int64) uint64 {
+	const n = 1 << clusterBits
+	x := min(max(lon+180e9, 0)*n/360e9, n-1)
+	y := min(max(lat+90e9, 0)*n/180e9, n-1)
+	var d uint64
+	for s := int64(n / 2); s > 0; s /= 2 {
+		var rx, ry int64
+		if x&s > 0 {
+			rx = 1
+		}
+		if y&s > 0 {
+			ry = 1
+		}
+		d += uint64(s * s * ((3 * rx) ^ ry))
+		// Rotate the quadrant, so that the curve stays continuous.
+		if ry == 0 {
+			if rx == 1 {
+				x, y = n-1-x, n-1-y
+			}
+			x, y = y, x
+		}
+	}
+	return d
+}
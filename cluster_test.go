@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestHilbertCell(t *testing.T) {
+	// The 8x8 cells at the origin of the curve must be visited one after
+	// another, moving to a neighbouring cell each time.
+	const n = 1 << clusterBits
+	type xy struct{ x, y int64 }
+	cells := make(map[uint64]xy)
+	for x := int64(0); x < 8; x++ {
+		for y := int64(0); y < 8; y++ {
+			lon := -180e9 + (2*x+1)*360e9/n/2
+			lat := -90e9 + (2*y+1)*180e9/n/2
+			cells[hilbertCell(lat, lon)] = xy{x, y}
+		}
+	}
+	for d := uint64(0); d < 64; d++ {
+		cell, ok := cells[d]
+		if !ok {
+			t.Fatalf("cell %d was not visited", d)
+		} else if d == 0 {
+			continue
+		}
+		prev := cells[d-1]
+		if dist := abs(cell.x-prev.x) + abs(cell.y-prev.y); dist != 1 {
+			t.Errorf("cells %d and %d are not neighbours", d-1, d)
+		}
+	}
+	if hilbertCell(-100e9, -200e9) != 0 {
+		t.Error("locations outside of the world are not clamped")
+	}
+}
+
+func abs(x int64) int64 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
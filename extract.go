@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/codesoap/pbf-reblob/pbfio"
+	"github.com/codesoap/pbf-reblob/pbfproto"
+)
+
+// extractor selects the entities within a region. Which entities are
+// kept depends on the strategy:
+//   - simple: nodes inside the region, ways with at least one of these
+//     nodes and relations with at least one kept member.
+//   - complete-ways: like simple, but with all nodes of the kept ways.
+//   - smart: like complete-ways, but with all member ways, and their
+//     nodes, of kept multipolygon relations.
+type extractor struct {
+	bbox, polygonFile, strategy string
+
+	region region
+
+	// The entities found by collect. extraNodes and extraWays are
+	// outside the region, but completing kept ways or relations.
+	nodes, extraNodes, ways, extraWays, relations idSet
+
+	// bounds contains the region and all kept nodes.
+	bounds pbfio.BBox
+}
+
+func (x *extractor) register(flags *flag.FlagSet) {
+	flags.StringVar(&x.bbox, "bbox", "", "extract the region given as 'left,bottom,right,top' in degrees")
+	flags.StringVar(&x.polygonFile, "polygon", "", "extract the region given by the (multi)polygon in this GeoJSON file")
+	flags.StringVar(&x.strategy, "strategy", "complete-ways", "either 'simple', 'complete-ways' or 'smart'")
+}
+
+// setup checks the options and reads the region.
+func (x *extractor) setup() error {
+	if x.strategy != "simple" && x.strategy != "complete-ways" && x.strategy != "smart" {
+		return fmt.Errorf("unknown strategy '%s'", x.strategy)
+	}
+	var err error
+	switch {
+	case x.bbox != "" && x.polygonFile != "":
+		return fmt.Errorf("only one of -bbox and -polygon may be given")
+	case x.bbox != "":
+		x.region, err = parseBBox(x.bbox)
+	case x.polygonFile != "":
+		x.region, err = readPolygon(x.polygonFile)
+	default:
+		return fmt.Errorf("either -bbox or -polygon is needed")
+	}
+	return err
+}
+
+// collect reads cfg.inFile to find the entities to keep. The input must
+// be sorted by type. With the smart strategy, the input may be read a
+// second time to find the nodes of member ways. If nodes outside of the
+// region are kept, the input is read once more to find their bounds.
+func (x *extractor) collect(cfg config) error {
+	x.nodes, x.extraNodes, x.ways, x.extraWays, x.relations = idSet{}, idSet{}, idSet{}, idSet{}, idSet{}
+	var lastType pbfio.EntityType
+	unsorted := false
+	err := forEachEntity(cfg, func(e *pbfio.Entity) {
+		if e.Type < lastType {
+			unsorted = true
+		}
+		lastType = e.Type
+		switch e.Type {
+		case pbfio.NodeType:
+			if x.region.contains(e.Lat, e.Lon) {
+				x.nodes.add(e.ID)
+			}
+		case pbfio.WayType:
+			if !hasAny(x.nodes, e.Refs) {
+				return
+			}
+			x.ways.add(e.ID)
+			if x.strategy != "simple" {
+				for _, ref := range e.Refs {
+					if !x.nodes.has(ref) {
+						x.extraNodes.add(ref)
+					}
+				}
+			}
+		case pbfio.RelationType:
+			if !x.referencesKept(e) {
+				return
+			}
+			x.relations.add(e.ID)
+			if x.strategy == "smart" && isMultipolygon(e) {
+				for _, member := range e.Members {
+					if member.Type == pbfio.WayType && !x.ways.has(member.ID) {
+						x.extraWays.add(member.ID)
+					}
+				}
+			}
+		}
+	})
+	if err != nil {
+		return err
+	} else if unsorted {
+		// Sorting while extracting does not help, because the entities
+		// are collected from the unsorted input.
+		return fmt.Errorf("input is not sorted by type; sort it with 'pbf-reblob -sort' before extracting")
+	}
+	if len(x.extraWays) > 0 {
+		err = forEachEntity(cfg, func(e *pbfio.Entity) {
+			if e.Type == pbfio.WayType && x.extraWays.has(e.ID) {
+				for _, ref := range e.Refs {
+					if !x.nodes.has(ref) {
+						x.extraNodes.add(ref)
+					}
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	x.bounds = x.region.bounds()
+	if len(x.extraNodes) == 0 {
+		return nil
+	}
+	return forEachEntity(cfg, func(e *pbfio.Entity) {
+		if e.Type == pbfio.NodeType && x.extraNodes.has(e.ID) {
+			x.bounds.Left, x.bounds.Right = min(x.bounds.Left, e.Lon), max(x.bounds.Right, e.Lon)
+			x.bounds.Bottom, x.bounds.Top = min(x.bounds.Bottom, e.Lat), max(x.bounds.Top, e.Lat)
+		}
+	})
+}
+
+func hasAny(s idSet, ids []int64) bool {
+	for _, id := range ids {
+		if s.has(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// referencesKept reports whether the relation e has a member within the
+// region or a kept way or relation. Only relations before e are
+// considered.
+func (x *extractor) referencesKept(e *pbfio.Entity) bool {
+	for _, member := range e.Members {
+		switch member.Type {
+		case pbfio.NodeType:
+			if x.nodes.has(member.ID) {
+				return true
+			}
+		case pbfio.WayType:
+			if x.ways.has(member.ID) {
+				return true
+			}
+		case pbfio.RelationType:
+			if x.relations.has(member.ID) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isMultipolygon(e *pbfio.Entity) bool {
+	for _, tag := range e.Tags {
+		if tag.Key == "type" {
+			return tag.Value == "multipolygon"
+		}
+	}
+	return false
+}
+
+func (x *extractor) keeps(e *pbfio.Entity) bool {
+	switch e.Type {
+	case pbfio.NodeType:
+		return x.nodes.has(e.ID) || x.extraNodes.has(e.ID)
+	case pbfio.WayType:
+		return x.ways.has(e.ID) || x.extraWays.has(e.ID)
+	case pbfio.RelationType:
+		return x.relations.has(e.ID)
+	}
+	return false
+}
+
+// headerBBox returns the bounding box of the region and all kept nodes.
+func (x *extractor) headerBBox() *pbfproto.HeaderBBox {
+	bbox := x.bounds
+	return &pbfproto.HeaderBBox{
+		Left:   &bbox.Left,
+		Right:  &bbox.Right,
+		Top:    &bbox.Top,
+		Bottom: &bbox.Bottom,
+	}
+}
+
+// region is an area to extract. Locations are given in nanodegrees.
+type region interface {
+	contains(lat, lon int64) bool
+	bounds() pbfio.BBox
+}
+
+type bboxRegion pbfio.BBox
+
+// parseBBox parses a bounding box given as left,bottom,right,top in
+// degrees.
+func parseBBox(s string) (bboxRegion, error) {
+	var values [4]int64
+	fields := strings.Split(s, ",")
+	if len(fields) != len(values) {
+		return bboxRegion{}, fmt.Errorf("bounding box '%s' does not have 4 values", s)
+	}
+	for i, field := range fields {
+		v, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return bboxRegion{}, fmt.Errorf("invalid bounding box '%s': %v", s, err)
+		}
+		values[i] = int64(math.Round(v * 1e9))
+	}
+	b := bboxRegion{Left: values[0], Bottom: values[1], Right: values[2], Top: values[3]}
+	if b.Left > b.Right || b.Bottom > b.Top {
+		return bboxRegion{}, fmt.Errorf("invalid bounding box '%s': left must not be greater than right and bottom not greater than top", s)
+	}
+	return b, nil
+}
+
+func (b bboxRegion) contains(lat, lon int64) bool {
+	return lon >= b.Left && lon <= b.Right && lat >= b.Bottom && lat <= b.Top
+}
+
+func (b bboxRegion) bounds() pbfio.BBox {
+	return pbfio.BBox(b)
+}
+
+// polygonRegion is the union of polygons. Each polygon is a list of
+// rings of points, where the first ring is the outer one and the others
+// are holes.
+type polygonRegion struct {
+	polygons [][][]point
+	bbox     bboxRegion
+}
+
+// point is a location in nanodegrees.
+type point struct {
+	lon, lat int64
+}
+
+// readPolygon reads a Polygon or MultiPolygon from a GeoJSON file. The
+// geometries of Features and FeatureCollections are used as well.
+func readPolygon(file string) (*polygonRegion, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var obj geoJSON
+	if err = json.Unmarshal(data, &obj); err != nil {
+		return nil, fmt.Errorf("could not parse '%s': %v", file, err)
+	}
+	r := &polygonRegion{}
+	if err = r.add(obj); err != nil {
+		return nil, fmt.Errorf("invalid GeoJSON in '%s': %v", file, err)
+	} else if len(r.polygons) == 0 {
+		return nil, fmt.Errorf("'%s' contains no polygon", file)
+	}
+	first := true
+	for _, polygon := range r.polygons {
+		for _, p := range polygon[0] {
+			if first || p.lon < r.bbox.Left {
+				r.bbox.Left = p.lon
+			}
+			if first || p.lon > r.bbox.Right {
+				r.bbox.Right = p.lon
+			}
+			if first || p.lat < r.bbox.Bottom {
+				r.bbox.Bottom = p.lat
+			}
+			if first || p.lat > r.bbox.Top {
+				r.bbox.Top = p.lat
+			}
+			first = false
+		}
+	}
+	return r, nil
+}
+
+type geoJSON struct {
+	Type        string          `json:"type"`
+	Features    []geoJSON       `json:"features"`
+	Geometry    *geoJSON        `json:"geometry"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+func (r *polygonRegion) add(obj geoJSON) error {
+	switch obj.Type {
+	case "FeatureCollection":
+		for _, feature := range obj.Features {
+			if err := r.add(feature); err != nil {
+				return err
+			}
+		}
+	case "Feature":
+		if obj.Geometry != nil {
+			return r.add(*obj.Geometry)
+		}
+	case "Polygon":
+		var rings [][][]float64
+		if err := json.Unmarshal(obj.Coordinates, &rings); err != nil {
+			return err
+		}
+		return r.addPolygon(rings)
+	case "MultiPolygon":
+		var polygons [][][][]float64
+		if err := json.Unmarshal(obj.Coordinates, &polygons); err != nil {
+			return err
+		}
+		for _, rings := range polygons {
+			if err := r.addPolygon(rings); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *polygonRegion) addPolygon(rings [][][]float64) error {
+	if len(rings) == 0 {
+		return nil
+	}
+	var polygon [][]point
+	for _, ring := range rings {
+		var points []point
+		for _, position := range ring {
+			if len(position) < 2 {
+				return fmt.Errorf("position with %d coordinates", len(position))
+			}
+			points = append(points, point{
+				lon: int64(math.Round(position[0] * 1e9)),
+				lat: int64(math.Round(position[1] * 1e9)),
+			})
+		}
+		if len(points) < 3 {
+			return fmt.Errorf("ring with %d positions", len(points))
+		}
+		polygon = append(polygon, points)
+	}
+	r.polygons = append(r.polygons, polygon)
+	return nil
+}
+
+func (r *polygonRegion) contains(lat, lon int64) bool {
+	if !r.bbox.contains(lat, lon) {
+		return false
+	}
+	for _, polygon := range r.polygons {
+		// A point is inside the polygon, if a ray from it crosses the
+		// rings an odd number of times; this also handles holes.
+		inside := false
+		for _, ring := range polygon {
+			for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+				a, b := ring[i], ring[j]
+				if (a.lat > lat) != (b.lat > lat) &&
+					float64(lon) < float64(b.lon-a.lon)*float64(lat-a.lat)/float64(b.lat-a.lat)+float64(a.lon) {
+					inside = !inside
+				}
+			}
+		}
+		if inside {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *polygonRegion) bounds() pbfio.BBox {
+	return pbfio.BBox(r.bbox)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/codesoap/pbf-reblob/pbfio"
+)
+
+func TestRegions(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "region.json")
+	polygon := `{"type": "Polygon", "coordinates": [
+		[[0, 0], [4, 0], [4, 4], [0, 4], [0, 0]],
+		[[1, 1], [3, 1], [3, 3], [1, 3], [1, 1]]
+	]}`
+	if err := os.WriteFile(file, []byte(polygon), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := readPolygon(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := parseBBox("0,0,4,2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		lat, lon         float64
+		inPolygon, inBox bool
+	}{
+		{0.5, 0.5, true, true},
+		{2, 2, false, true},
+		{3.5, 2, true, false},
+		{2, 5, false, false},
+		{-1, 2, false, false},
+	}
+	for _, test := range tests {
+		lat, lon := int64(test.lat*1e9), int64(test.lon*1e9)
+		if p.contains(lat, lon) != test.inPolygon {
+			t.Errorf("polygon: wrong result for %g,%g", test.lat, test.lon)
+		}
+		if b.contains(lat, lon) != test.inBox {
+			t.Errorf("bbox: wrong result for %g,%g", test.lat, test.lon)
+		}
+	}
+	if bounds := p.bounds(); bounds.Right != 4e9 || bounds.Bottom != 0 {
+		t.Errorf("wrong bounds %+v", bounds)
+	}
+	for _, s := range []string{"1,2,3", "1,2,0,3", "a,b,c,d"} {
+		if _, err := parseBBox(s); err == nil {
+			t.Errorf("%s: expected error", s)
+		}
+	}
+}
+
+func TestExtractStrategies(t *testing.T) {
+	// The region is 0,0,10,10; nodes are given as latitude, longitude in
+	// degrees.
+	nodes := [][3]int64{{1, 5, 5}, {2, 20, 5}, {3, 20, 20}, {4, 6, 5}, {5, 30, 30}, {6, -40, 40}}
+	entities := []pbfio.Entity{
+		{Type: pbfio.WayType, ID: 10, Refs: []int64{1, 2}},
+		{Type: pbfio.WayType, ID: 11, Refs: []int64{3, 5}},
+		{Type: pbfio.WayType, ID: 12, Refs: []int64{4}},
+		{Type: pbfio.WayType, ID: 13, Refs: []int64{6}},
+		{Type: pbfio.RelationType, ID: 20, Tags: []pbfio.Tag{{Key: "type", Value: "multipolygon"}}, Members: []pbfio.Member{
+			{Type: pbfio.WayType, ID: 10, Role: "outer"}, {Type: pbfio.WayType, ID: 11, Role: "outer"},
+		}},
+		// Relation 22 is kept, but comes after relation 21.
+		{Type: pbfio.RelationType, ID: 21, Members: []pbfio.Member{{Type: pbfio.RelationType, ID: 22}}},
+		{Type: pbfio.RelationType, ID: 22, Members: []pbfio.Member{{Type: pbfio.NodeType, ID: 4}}},
+		{Type: pbfio.RelationType, ID: 23, Members: []pbfio.Member{{Type: pbfio.RelationType, ID: 20}}},
+		{Type: pbfio.RelationType, ID: 24, Members: []pbfio.Member{{Type: pbfio.WayType, ID: 13}}},
+	}
+	var builder pbfio.BlockBuilder
+	for _, n := range nodes {
+		builder.Add(&pbfio.Entity{Type: pbfio.NodeType, ID: n[0], Lat: n[1] * 1e9, Lon: n[2] * 1e9})
+	}
+	for i := range entities {
+		builder.Add(&entities[i])
+	}
+	all, err := pbfio.Entities(builder.Build())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range all {
+		builder.Add(&all[i])
+	}
+	cfg := config{inFile: writeTestFile(t, builder.Build())}
+
+	tests := []struct {
+		strategy string
+		want     []string
+		bounds   pbfio.BBox
+	}{
+		{"simple", []string{"n1", "n4", "w10", "w12", "r20", "r22", "r23"}, pbfio.BBox{Right: 10e9, Top: 10e9}},
+		{"complete-ways", []string{"n1", "n2", "n4", "w10", "w12", "r20", "r22", "r23"}, pbfio.BBox{Right: 10e9, Top: 20e9}},
+		{"smart", []string{"n1", "n2", "n3", "n4", "n5", "w10", "w11", "w12", "r20", "r22", "r23"}, pbfio.BBox{Right: 30e9, Top: 30e9}},
+	}
+	for _, test := range tests {
+		x := extractor{bbox: "0,0,10,10", strategy: test.strategy}
+		if err := x.setup(); err != nil {
+			t.Fatal(err)
+		}
+		if err := x.collect(cfg); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for i := range all {
+			if x.keeps(&all[i]) {
+				got = append(got, fmt.Sprintf("%c%d", all[i].Type.String()[0], all[i].ID))
+			}
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.strategy, got, test.want)
+		}
+		if x.bounds != test.bounds {
+			t.Errorf("%s: got bounds %+v, want %+v", test.strategy, x.bounds, test.bounds)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/codesoap/pbf-reblob/pbfio"
+	"github.com/codesoap/pbf-reblob/pbfproto"
+)
+
+// entityFilter selects entities by their tags. An entity is kept, if it
+// matches one of the expressions or, if references is set, it is
+// referenced by a matching entity.
+type entityFilter struct {
+	exprs      []filterExpr
+	references bool
+
+	// The IDs of entities referenced by matching ones. They are filled
+	// by collectReferences.
+	nodes, ways, relations idSet
+}
+
+// filterExpr matches entities of the given types with a tag matching
+// key and value. Key and value are patterns for path.Match.
+type filterExpr struct {
+	types      []pbfio.EntityType
+	key, value string
+}
+
+func (f *entityFilter) register(flags *flag.FlagSet) {
+	flags.Func("filter", "only keep entities with a matching tag; 'key', 'key=value' or with type prefix, e.g. 'w/highway=*'; may be repeated",
+		func(s string) error {
+			expr, err := parseFilterExpr(s)
+			f.exprs = append(f.exprs, expr)
+			return err
+		})
+	flags.BoolVar(&f.references, "filter-references", false, "also keep the nodes of matching ways and the members of matching relations; reads the input up to three times")
+}
+
+// parseFilterExpr parses expressions like 'amenity=restaurant',
+// 'highway' or 'nw/name=*'.
+func parseFilterExpr(s string) (filterExpr, error) {
+	var expr filterExpr
+	if types, rest, ok := strings.Cut(s, "/"); ok && types != "" && strings.Trim(types, "nwr") == "" {
+		for _, c := range types {
+			expr.types = append(expr.types, pbfio.EntityType(strings.IndexRune("nwr", c)))
+		}
+		s = rest
+	}
+	expr.key, expr.value, _ = strings.Cut(s, "=")
+	if expr.value == "" {
+		expr.value = "*"
+	}
+	if expr.key == "" {
+		return expr, fmt.Errorf("missing key")
+	}
+	for _, pattern := range []string{expr.key, expr.value} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return expr, fmt.Errorf("invalid pattern '%s': %v", pattern, err)
+		}
+	}
+	return expr, nil
+}
+
+func (f *entityFilter) active() bool {
+	return len(f.exprs) > 0
+}
+
+func (f *entityFilter) matches(e *pbfio.Entity) bool {
+	for _, expr := range f.exprs {
+		if len(expr.types) > 0 && !slices.Contains(expr.types, e.Type) {
+			continue
+		}
+		for _, tag := range e.Tags {
+			if ok, _ := path.Match(expr.key, tag.Key); !ok {
+				continue
+			} else if ok, _ := path.Match(expr.value, tag.Value); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (f *entityFilter) keeps(e *pbfio.Entity) bool {
+	if f.matches(e) {
+		return true
+	} else if !f.references {
+		return false
+	}
+	switch e.Type {
+	case pbfio.NodeType:
+		return f.nodes.has(e.ID)
+	case pbfio.WayType:
+		return f.ways.has(e.ID)
+	case pbfio.RelationType:
+		return f.relations.has(e.ID)
+	}
+	return false
+}
+
+// collectReferences reads cfg.inFile to find the entities referenced by
+// matching ones. The nodes of matching ways and the members of matching
+// relations are collected. If relations have way members, the input is
+// read again to collect the nodes of these ways. The members of member
+// relations are not collected.
+func (f *entityFilter) collectReferences(cfg config) error {
+	f.nodes, f.ways, f.relations = idSet{}, idSet{}, idSet{}
+	err := forEachEntity(cfg, func(e *pbfio.Entity) {
+		if !f.matches(e) {
+			return
+		}
+		switch e.Type {
+		case pbfio.WayType:
+			for _, ref := range e.Refs {
+				f.nodes.add(ref)
+			}
+		case pbfio.RelationType:
+			for _, member := range e.Members {
+				switch member.Type {
+				case pbfio.NodeType:
+					f.nodes.add(member.ID)
+				case pbfio.WayType:
+					f.ways.add(member.ID)
+				case pbfio.RelationType:
+					f.relations.add(member.ID)
+				}
+			}
+		}
+	})
+	if err != nil || len(f.ways) == 0 {
+		return err
+	}
+	return forEachEntity(cfg, func(e *pbfio.Entity) {
+		if e.Type == pbfio.WayType && f.ways.has(e.ID) {
+			for _, ref := range e.Refs {
+				f.nodes.add(ref)
+			}
+		}
+	})
+}
+
+// forEachEntity passes every entity of cfg.inFile to fn.
+func forEachEntity(cfg config, fn func(e *pbfio.Entity)) error {
+	blobs := make(chan pbfio.DecodedBlob)
+	// Problems are reported by the last pass, so Warn is not set.
+	go pbfio.StreamBlobs(cfg.inFile, pbfio.ReaderOptions{Resync: cfg.resync}, blobs)
+	var err error
+	for blob := range blobs {
+		if err != nil {
+			// Drain blobs, so that StreamBlobs can finish.
+			continue
+		} else if blob.Err != nil {
+			err = fmt.Errorf("could not read blob: %v", blob.Err)
+			continue
+		} else if blob.PrimitiveBlock == nil {
+			continue
+		}
+		var entities []pbfio.Entity
+		entities, err = pbfio.Entities(blob.PrimitiveBlock)
+		blob.PrimitiveBlock.ReturnToVTPool()
+		if err != nil {
+			err = fmt.Errorf("%s: %v", blob.Position(), err)
+			continue
+		}
+		for i := range entities {
+			fn(&entities[i])
+		}
+	}
+	return err
+}
+
+// filterEntities returns a channel, which receives the blobs of blobsIn
+// with only the entities for which keeps returns true. Blobs without
+// kept entities are left out; changesets are dropped. It is closed after
+// blobsIn.
+func filterEntities(blobsIn chan pbfio.DecodedBlob, keeps func(e *pbfio.Entity) bool) chan pbfio.DecodedBlob {
+	blobsOut := make(chan pbfio.DecodedBlob)
+	go func() {
+		defer close(blobsOut)
+		changesetsDropped := false
+		for blob := range blobsIn {
+			if blob.Err == nil && blob.PrimitiveBlock != nil {
+				if !changesetsDropped && blockKinds(blob.PrimitiveBlock)&kindChangesets != 0 {
+					fmt.Fprintf(os.Stderr, "Warning: %s contains changesets, which are dropped when filtering.\n", blob.Position())
+					changesetsDropped = true
+				}
+				block, err := filterBlock(blob.PrimitiveBlock, keeps)
+				if err != nil {
+					blob.Err = fmt.Errorf("%s: %v", blob.Position(), err)
+				} else if block == nil {
+					continue
+				} else if block != blob.PrimitiveBlock {
+					blob.PrimitiveBlock.ReturnToVTPool()
+					blob.PrimitiveBlock, blob.RawBlob = block, nil
+					blob.RawSize = block.SizeVT()
+				}
+			}
+			blobsOut <- blob
+		}
+	}()
+	return blobsOut
+}
+
+// filterBlock returns a block with the kept entities of block. If all
+// entities are kept and block contains no changesets, block itself is
+// returned; if none are kept, nil is returned.
+func filterBlock(block *pbfproto.PrimitiveBlock, keeps func(e *pbfio.Entity) bool) (*pbfproto.PrimitiveBlock, error) {
+	entities, err := pbfio.Entities(block)
+	if err != nil {
+		return nil, err
+	}
+	kept := entities[:0]
+	for i := range entities {
+		if keeps(&entities[i]) {
+			kept = append(kept, entities[i])
+		}
+	}
+	if len(kept) == len(entities) && blockKinds(block)&kindChangesets == 0 {
+		return block, nil
+	}
+	// The builder does not use offsets, so the granularity must divide
+	// them, too.
+	builder := pbfio.BlockBuilder{
+		Granularity:     int32(gcd(int64(block.GetGranularity()), gcd(block.GetLatOffset(), block.GetLonOffset()))),
+		DateGranularity: block.GetDateGranularity(),
+	}
+	for i := range kept {
+		builder.Add(&kept[i])
+	}
+	return builder.Build(), nil
+}
+
+// idSet is a set of entity IDs. IDs are stored in bitmaps of 64
+// consecutive IDs, to save memory with dense IDs.
+type idSet map[int64]uint64
+
+func (s idSet) add(id int64) {
+	s[id>>6] |= 1 << (id & 63)
+}
+
+func (s idSet) has(id int64) bool {
+	return s[id>>6]&(1<<(id&63)) != 0
+}
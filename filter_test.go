@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/codesoap/pbf-reblob/pbfio"
+	"github.com/codesoap/pbf-reblob/pbfproto"
+)
+
+func TestEntityFilterMatches(t *testing.T) {
+	way := pbfio.Entity{Type: pbfio.WayType, Tags: []pbfio.Tag{
+		{Key: "highway", Value: "residential"},
+		{Key: "name:en", Value: "Main Street"},
+	}}
+	tests := []struct {
+		expr  string
+		match bool
+	}{
+		{"highway", true},
+		{"highway=*", true},
+		{"highway=residential", true},
+		{"highway=primary", false},
+		{"w/highway", true},
+		{"nr/highway", false},
+		{"name:*=Main*", true},
+		{"amenity", false},
+	}
+	for _, test := range tests {
+		expr, err := parseFilterExpr(test.expr)
+		if err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+			continue
+		}
+		f := entityFilter{exprs: []filterExpr{expr}}
+		if f.matches(&way) != test.match {
+			t.Errorf("%s: got match %t", test.expr, !test.match)
+		}
+	}
+	for _, expr := range []string{"", "=value", "w/", "[=x"} {
+		if _, err := parseFilterExpr(expr); err == nil {
+			t.Errorf("%s: expected error", expr)
+		}
+	}
+}
+
+func TestIDSet(t *testing.T) {
+	s := idSet{}
+	ids := []int64{-65, -1, 0, 63, 64, 1 << 40}
+	for _, id := range ids {
+		s.add(id)
+	}
+	for _, id := range ids {
+		if !s.has(id) {
+			t.Errorf("%d is missing", id)
+		}
+	}
+	for _, id := range []int64{-64, -2, 1, 62, 65, 1<<40 + 1} {
+		if s.has(id) {
+			t.Errorf("%d was not added", id)
+		}
+	}
+}
+
+// filterTestBlock returns a block with nodes 1 to 6, ways 10 to 12 and
+// relations 20 to 22. Its lat_offset is not a multiple of its
+// granularity.
+func filterTestBlock() *pbfproto.PrimitiveBlock {
+	entities := []pbfio.Entity{
+		{Type: pbfio.WayType, ID: 10, Refs: []int64{1, 2}, Tags: []pbfio.Tag{{Key: "highway", Value: "path"}}},
+		{Type: pbfio.WayType, ID: 11, Refs: []int64{3, 4}},
+		{Type: pbfio.WayType, ID: 12, Refs: []int64{5}},
+		{Type: pbfio.RelationType, ID: 20, Tags: []pbfio.Tag{{Key: "route", Value: "bus"}}, Members: []pbfio.Member{
+			{Type: pbfio.WayType, ID: 11}, {Type: pbfio.NodeType, ID: 6}, {Type: pbfio.RelationType, ID: 21},
+		}},
+		{Type: pbfio.RelationType, ID: 21, Members: []pbfio.Member{{Type: pbfio.WayType, ID: 12}}},
+		{Type: pbfio.RelationType, ID: 22, Members: []pbfio.Member{{Type: pbfio.NodeType, ID: 1}}},
+	}
+	var builder pbfio.BlockBuilder
+	for id := int64(1); id <= 6; id++ {
+		builder.Add(&pbfio.Entity{Type: pbfio.NodeType, ID: id, Lat: id * 1000, Lon: -id * 1000})
+	}
+	for i := range entities {
+		builder.Add(&entities[i])
+	}
+	block := builder.Build()
+	block.LatOffset = ptr(int64(50))
+	return block
+}
+
+// writeTestFile writes an OSMHeader and blocks to a temporary file and
+// returns its path.
+func writeTestFile(t *testing.T, blocks ...*pbfproto.PrimitiveBlock) string {
+	file := filepath.Join(t.TempDir(), "in.osm.pbf")
+	blobs := make(chan pbfio.DecodedBlob)
+	errs := make(chan error)
+	go pbfio.WriteBlobs(file, pbfio.WriterOptions{Compression: "zlib"}, blobs, errs)
+	blobs <- pbfio.DecodedBlob{
+		BlobHeader:  &pbfproto.BlobHeader{Type: ptr("OSMHeader")},
+		HeaderBlock: &pbfproto.HeaderBlock{RequiredFeatures: []string{"OsmSchema-V0.6", "DenseNodes"}},
+	}
+	for _, block := range blocks {
+		blobs <- pbfio.DecodedBlob{BlobHeader: &pbfproto.BlobHeader{Type: ptr("OSMData")}, PrimitiveBlock: block}
+	}
+	close(blobs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// keptIDs returns the IDs of the entities of block, like "n1".
+func keptIDs(t *testing.T, block *pbfproto.PrimitiveBlock) []string {
+	entities, err := pbfio.Entities(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, e := range entities {
+		ids = append(ids, fmt.Sprintf("%c%d", e.Type.String()[0], e.ID))
+		if e.Type == pbfio.NodeType && (e.Lat != e.ID*1000+50 || e.Lon != -e.ID*1000) {
+			t.Errorf("node %d has location %d,%d", e.ID, e.Lat, e.Lon)
+		}
+	}
+	return ids
+}
+
+func TestFilterReferences(t *testing.T) {
+	tests := []struct {
+		references bool
+		want       []string
+	}{
+		{false, []string{"w10", "r20"}},
+		// The nodes of member relations' ways are not kept.
+		{true, []string{"n1", "n2", "n3", "n4", "n6", "w10", "w11", "r20", "r21"}},
+	}
+	cfg := config{inFile: writeTestFile(t, filterTestBlock())}
+	for _, test := range tests {
+		var f entityFilter
+		for _, s := range []string{"highway", "r/route=bus"} {
+			expr, err := parseFilterExpr(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.exprs = append(f.exprs, expr)
+		}
+		f.references = test.references
+		if test.references {
+			if err := f.collectReferences(cfg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		block, err := filterBlock(filterTestBlock(), f.keeps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := keptIDs(t, block); !slices.Equal(got, test.want) {
+			t.Errorf("with references %t, got %v, want %v", test.references, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codesoap/pbf-reblob/pbfio"
+	"github.com/codesoap/pbf-reblob/pbfproto"
+)
+
+// reblobFeaturePrefix starts the optional feature, in which stamp
+// records how a file was reblobbed.
+const reblobFeaturePrefix = "pbf-reblob:"
+
+// stamp sets the writing program of h to pbf-reblob and records the
+// blob size limit and compression of cfg as an optional feature.
+func stamp(h *pbfproto.HeaderBlock, cfg config) {
+	program := "pbf-reblob"
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		program += " " + info.Main.Version
+	}
+	h.Writingprogram = &program
+	h.OptionalFeatures = slices.DeleteFunc(h.OptionalFeatures, func(feature string) bool {
+		return strings.HasPrefix(feature, reblobFeaturePrefix)
+	})
+	feature := fmt.Sprintf("%ssize=%d,compression=%s", reblobFeaturePrefix, cfg.maxBlobSize, cfg.compression)
+	h.OptionalFeatures = append(h.OptionalFeatures, feature)
+}
+
+// headerEdits are changes to the HeaderBlock, that have been requested
+// on the command line, in the order they were given.
+type headerEdits []func(*pbfproto.HeaderBlock)
+
+// register adds the flags for editing the HeaderBlock to flags. A field
+// is removed, if an empty value is given for it.
+func (e *headerEdits) register(flags *flag.FlagSet) {
+	flags.Func("writingprogram", "set the writing `program` in the OSMHeader", func(s string) error {
+		e.add(func(h *pbfproto.HeaderBlock) { h.Writingprogram = optional(s, s) })
+		return nil
+	})
+	flags.Func("source", "set the `source` in the OSMHeader", func(s string) error {
+		e.add(func(h *pbfproto.HeaderBlock) { h.Source = optional(s, s) })
+		return nil
+	})
+	flags.Func("replication-timestamp", "set the replication `time` in the OSMHeader; seconds since 1970 or RFC 3339", func(s string) error {
+		ts, err := parseTimestamp(s)
+		e.add(func(h *pbfproto.HeaderBlock) { h.OsmosisReplicationTimestamp = optional(s, ts) })
+		return err
+	})
+	flags.Func("replication-sequence", "set the replication sequence `number` in the OSMHeader", func(s string) error {
+		var seq int64
+		var err error
+		if s != "" {
+			seq, err = strconv.ParseInt(s, 10, 64)
+		}
+		e.add(func(h *pbfproto.HeaderBlock) { h.OsmosisReplicationSequenceNumber = optional(s, seq) })
+		return err
+	})
+	flags.Func("replication-url", "set the replication base `URL` in the OSMHeader", func(s string) error {
+		e.add(func(h *pbfproto.HeaderBlock) { h.OsmosisReplicationBaseUrl = optional(s, s) })
+		return nil
+	})
+}
+
+func (e *headerEdits) add(edit func(*pbfproto.HeaderBlock)) {
+	*e = append(*e, edit)
+}
+
+func (e headerEdits) apply(h *pbfproto.HeaderBlock) {
+	for _, edit := range e {
+		edit(h)
+	}
+}
+
+// optional returns a pointer to v, or nil if the flag value s is empty.
+func optional[T any](s string, v T) *T {
+	if s == "" {
+		return nil
+	}
+	return &v
+}
+
+func parseTimestamp(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	} else if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ts, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, errors.New("expected seconds since 1970 or RFC 3339")
+	}
+	return t.Unix(), nil
+}
+
+// runHeader rewrites the OSMHeader of a file. All other blobs are copied
+// unchanged.
+func runHeader(args []string) {
+	flags := flag.NewFlagSet("header", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:\n  pbf-reblob header [<OPTIONS>] <IN_FILE> <OUT_FILE>")
+		fmt.Fprintln(os.Stderr, "Only the OSMHeader is rewritten; all other blobs are copied unchanged.")
+		fmt.Fprintln(os.Stderr, "Fields are removed from the OSMHeader, if an empty value is given.")
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+	}
+	var edits headerEdits
+	edits.register(flags)
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	inFile, outFile := flags.Arg(0), flags.Arg(1)
+	if _, err := os.Stat(outFile); !errors.Is(err, os.ErrNotExist) {
+		fmt.Fprintf(os.Stderr, "The file '%s' already exists.\n", outFile)
+		os.Exit(1)
+	}
+	if err := rewriteHeader(inFile, outFile, edits); err != nil {
+		os.Remove(outFile)
+		fmt.Fprintf(os.Stderr, "Error: Could not rewrite header: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// editHeader applies edits to the OSMHeader of file. Because the header
+// may change its size, the whole file is rewritten; the result keeps the
+// permissions of file.
+func editHeader(file string, edits headerEdits) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), ".pbf-reblob-*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	if err = rewriteHeader(file, tmp.Name(), edits); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	// CreateTemp uses mode 0600 instead of the usual 0666 minus umask.
+	if err = os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = os.Rename(tmp.Name(), file); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("could not replace '%s': %v", file, err)
+	}
+	return nil
+}
+
+// rewriteHeader writes the OSMHeader of inFile with edits applied to
+// outFile, followed by the unchanged remainder of inFile.
+func rewriteHeader(inFile, outFile string, edits headerEdits) error {
+	in, err := os.Open(inFile)
+	if err != nil {
+		return fmt.Errorf("could not open in file '%s': %v", inFile, err)
+	}
+	defer in.Close()
+	reader := pbfio.NewBlobReader(in)
+	defer reader.Close()
+	osmHeader, err := reader.ReadBlob(0)
+	if err != nil {
+		return err
+	} else if osmHeader.HeaderBlock == nil {
+		return fmt.Errorf("expected blob of type 'OSMHeader' but got '%s'",
+			osmHeader.BlobHeader.GetType())
+	}
+	edits.apply(osmHeader.HeaderBlock)
+
+	compression := osmHeader.Compression
+	if compression != "raw" && compression != "zstd" {
+		compression = "zlib"
+	}
+	blobs := make(chan pbfio.DecodedBlob, 1)
+	errs := make(chan error)
+	blobs <- osmHeader
+	close(blobs)
+	go pbfio.WriteBlobs(outFile, pbfio.WriterOptions{Compression: compression}, blobs, errs)
+	if err, ok := <-errs; ok {
+		return fmt.Errorf("could not write header: %v", err)
+	}
+
+	out, err := os.OpenFile(outFile, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	dataStart := osmHeader.Offset + 4 + int64(osmHeader.HeaderSize) + int64(osmHeader.DataSize)
+	if _, err = io.Copy(out, io.NewSectionReader(in, dataStart, 1<<63-1-dataStart)); err != nil {
+		out.Close()
+		return fmt.Errorf("could not copy data blobs: %v", err)
+	}
+	return out.Close()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/codesoap/pbf-reblob/pbfio"
+	"github.com/codesoap/pbf-reblob/pbfproto"
+)
+
+// parseHeaderEdits parses args like the header command does.
+func parseHeaderEdits(args ...string) (headerEdits, error) {
+	var edits headerEdits
+	flags := flag.NewFlagSet("header", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	edits.register(flags)
+	return edits, flags.Parse(args)
+}
+
+// readTestHeader returns the OSMHeader of file and the data following
+// it.
+func readTestHeader(t *testing.T, file string) (*pbfproto.HeaderBlock, []byte) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := pbfio.NewBlobReader(bytes.NewReader(data))
+	defer reader.Close()
+	blob, err := reader.ReadBlob(0)
+	if err != nil {
+		t.Fatal(err)
+	} else if blob.HeaderBlock == nil {
+		t.Fatalf("%s does not start with an OSMHeader", file)
+	}
+	return blob.HeaderBlock, data[4+blob.HeaderSize+blob.DataSize:]
+}
+
+func TestRewriteHeader(t *testing.T) {
+	dir := t.TempDir()
+	inFile := writeTestFile(t, filterTestBlock(), filterTestBlock())
+	_, inData := readTestHeader(t, inFile)
+	edits, err := parseHeaderEdits("-source", "survey", "-writingprogram", "editor",
+		"-replication-timestamp", "2024-01-02T03:04:05Z", "-replication-sequence", "42",
+		"-replication-url", "https://example.com/replication")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setFile := filepath.Join(dir, "set.osm.pbf")
+	if err = rewriteHeader(inFile, setFile, edits); err != nil {
+		t.Fatal(err)
+	}
+	h, data := readTestHeader(t, setFile)
+	if h.GetSource() != "survey" || h.GetWritingprogram() != "editor" ||
+		h.GetOsmosisReplicationTimestamp() != 1704164645 || h.GetOsmosisReplicationSequenceNumber() != 42 ||
+		h.GetOsmosisReplicationBaseUrl() != "https://example.com/replication" {
+		t.Errorf("fields were not set: %v", h)
+	}
+	if len(h.RequiredFeatures) != 2 {
+		t.Errorf("got required features %v", h.RequiredFeatures)
+	}
+	if !bytes.Equal(data, inData) {
+		t.Errorf("data blobs were not copied unchanged")
+	}
+
+	// Empty values remove fields.
+	if edits, err = parseHeaderEdits("-source", "", "-replication-timestamp", "", "-replication-sequence", ""); err != nil {
+		t.Fatal(err)
+	}
+	removedFile := filepath.Join(dir, "removed.osm.pbf")
+	if err = rewriteHeader(setFile, removedFile, edits); err != nil {
+		t.Fatal(err)
+	}
+	h, data = readTestHeader(t, removedFile)
+	if h.Source != nil || h.OsmosisReplicationTimestamp != nil || h.OsmosisReplicationSequenceNumber != nil {
+		t.Errorf("fields were not removed: %v", h)
+	} else if h.GetWritingprogram() != "editor" || h.GetOsmosisReplicationBaseUrl() == "" {
+		t.Errorf("other fields were removed: %v", h)
+	}
+	if !bytes.Equal(data, inData) {
+		t.Errorf("data blobs were not copied unchanged")
+	}
+
+	for _, args := range [][]string{{"-replication-timestamp", "yesterday"}, {"-replication-sequence", "x"}} {
+		if _, err = parseHeaderEdits(args...); err == nil {
+			t.Errorf("%v: expected error", args)
+		}
+	}
+}
+
+func TestEditHeaderKeepsMode(t *testing.T) {
+	file := writeTestFile(t, filterTestBlock())
+	if err := os.Chmod(file, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := dropSortFeature(file); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0o640 {
+		t.Errorf("got mode %v after editing the header, want %v", info.Mode().Perm(), os.FileMode(0o640))
+	}
+}
+
+func TestStamp(t *testing.T) {
+	dir := t.TempDir()
+	inFile := writeTestFile(t, filterTestBlock())
+	// Stamping an already stamped file must replace the old feature.
+	for i, compression := range []string{"zlib", "zstd"} {
+		cfg := config{
+			maxBlobSize: 1<<20 + i,
+			jobs:        1,
+			stamp:       true,
+			inFile:      inFile,
+			outFile:     filepath.Join(dir, compression+".osm.pbf"),
+			compression: compression,
+		}
+		reblob(cfg)
+		h, _ := readTestHeader(t, cfg.outFile)
+		if !strings.HasPrefix(h.GetWritingprogram(), "pbf-reblob") {
+			t.Errorf("got writing program '%s'", h.GetWritingprogram())
+		}
+		var stamps []string
+		for _, feature := range h.OptionalFeatures {
+			if strings.HasPrefix(feature, reblobFeaturePrefix) {
+				stamps = append(stamps, feature)
+			}
+		}
+		want := fmt.Sprintf("pbf-reblob:size=%d,compression=%s", cfg.maxBlobSize, compression)
+		if len(stamps) != 1 || stamps[0] != want {
+			t.Errorf("got stamps %v; want [%s]", stamps, want)
+		}
+		inFile = cfg.outFile
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codesoap/pbf-reblob/pbfio"
+	"github.com/codesoap/pbf-reblob/pbfproto"
+)
+
+func runImport(args []string) {
+	var cfg config
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:\n  pbf-reblob import [<OPTIONS>] <IN_FILE> <OUT_FILE>")
+		fmt.Fprintln(os.Stderr, "IN_FILE is an OSM XML file, which is converted to PBF.")
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+	}
+	flags.BoolVar(&cfg.verbose, "v", false, "verbose")
+	flags.BoolVar(&cfg.indexData, "i", false, "store entity types, ID ranges and bounding box in each BlobHeader")
+	flags.BoolVar(&cfg.sameKind, "t", false, "don't mix entity types in one blob")
+	flags.StringVar(&cfg.compression, "c", "zlib", "output compression; either 'raw', 'zlib' or 'zstd'")
+	size := flags.String("s", "16M", "uncompressed blob size limit; suffixes 'k' and 'M' allowed")
+	cfg.headerEdits.register(flags)
+	flags.Parse(args)
+	if flags.NArg() != 2 ||
+		cfg.compression != "raw" &&
+			cfg.compression != "zlib" &&
+			cfg.compression != "zstd" {
+		flags.Usage()
+		os.Exit(1)
+	}
+	cfg.inFile, cfg.outFile = flags.Arg(0), flags.Arg(1)
+	if _, err := os.Stat(cfg.outFile); !errors.Is(err, os.ErrNotExist) {
+		fmt.Fprintf(os.Stderr, "The file '%s' already exists.\n", cfg.outFile)
+		os.Exit(1)
+	}
+	setMaxBlobSize(&cfg, *size)
+	if err := importXML(cfg); err != nil {
+		os.Remove(cfg.outFile)
+		fmt.Fprintf(os.Stderr, "Error: Could not import '%s': %v\n", cfg.inFile, err)
+		os.Exit(1)
+	}
+}
+
+// importXML converts the OSM XML file cfg.inFile to the PBF file
+// cfg.outFile. The OSMHeader is written before the first data blob.
+// If features, that are only found later, are missing from it, it is
+// rewritten at the end.
+func importXML(cfg config) error {
+	in, err := os.Open(cfg.inFile)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	d := xmlDecoder{decoder: xml.NewDecoder(bufio.NewReader(in))}
+
+	header := &pbfproto.HeaderBlock{
+		RequiredFeatures: []string{"OsmSchema-V0.6", "DenseNodes"},
+		OptionalFeatures: []string{sortFeature},
+	}
+	stamp(header, cfg)
+	blobsOut := make(chan pbfio.DecodedBlob)
+	errs := make(chan error)
+	writerOpts := pbfio.WriterOptions{Compression: cfg.compression, IndexData: cfg.indexData}
+	go pbfio.WriteBlobs(cfg.outFile, writerOpts, blobsOut, errs)
+	headerSent := false
+	sendHeader := func() error {
+		if headerSent {
+			return nil
+		}
+		headerSent = true
+		cfg.headerEdits.apply(header)
+		blob := pbfio.DecodedBlob{
+			BlobHeader:  &pbfproto.BlobHeader{Type: ptr("OSMHeader")},
+			HeaderBlock: header,
+		}
+		select {
+		case blobsOut <- blob:
+			return nil
+		case err := <-errs:
+			return fmt.Errorf("could not write blob: %v", err)
+		}
+	}
+
+	var stats outputStats
+	var builder pbfio.BlockBuilder
+	emit := func() error {
+		if err := sendHeader(); err != nil {
+			return err
+		}
+		block := builder.Build()
+		blob := pbfio.DecodedBlob{
+			BlobHeader:     &pbfproto.BlobHeader{Type: ptr("OSMData")},
+			PrimitiveBlock: block,
+			RawSize:        block.SizeVT(),
+		}
+		return sendBlob(cfg, blob, blobsOut, errs, &stats)
+	}
+	var prevType pbfio.EntityType
+	for {
+		e, err := d.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			close(blobsOut)
+			<-errs
+			return err
+		}
+		if d.bbox != nil && !headerSent {
+			header.Bbox = d.bbox
+		}
+		if builder.Len() > 0 && (cfg.sameKind && e.Type != prevType || !builder.Fits(e, cfg.maxBlobSize)) {
+			if err = emit(); err != nil {
+				return err
+			}
+		}
+		builder.Add(e)
+		stats.order.next(kindOf(e.Type), e.ID)
+		prevType = e.Type
+	}
+	if builder.Len() > 0 {
+		err = emit()
+	} else {
+		err = sendHeader()
+	}
+	if err != nil {
+		return err
+	}
+	close(blobsOut)
+	if err, ok := <-errs; ok {
+		return fmt.Errorf("could not write blob: %v", err)
+	}
+
+	// Fix the features, that were not known when the header was written.
+	final := header.CloneVT()
+	if d.historical && !slices.Contains(final.RequiredFeatures, "HistoricalInformation") {
+		final.RequiredFeatures = append(final.RequiredFeatures, "HistoricalInformation")
+	}
+	if d.locationsOnWays && !slices.Contains(final.OptionalFeatures, "LocationsOnWays") {
+		final.OptionalFeatures = append(final.OptionalFeatures, "LocationsOnWays")
+	}
+	if stats.order.unsorted {
+		final.OptionalFeatures = slices.DeleteFunc(final.OptionalFeatures, func(feature string) bool {
+			return feature == sortFeature
+		})
+	}
+	if !slices.Equal(final.RequiredFeatures, header.RequiredFeatures) ||
+		!slices.Equal(final.OptionalFeatures, header.OptionalFeatures) {
+		edit := func(h *pbfproto.HeaderBlock) {
+			h.RequiredFeatures, h.OptionalFeatures = final.RequiredFeatures, final.OptionalFeatures
+		}
+		if err = editHeader(cfg.outFile, headerEdits{edit}); err != nil {
+			return fmt.Errorf("could not update the OSMHeader: %v", err)
+		}
+	}
+	if cfg.verbose {
+		log.Printf("Info: Wrote %d entities in %d data blobs", stats.order.count, stats.blobs)
+	}
+	return nil
+}
+
+func kindOf(t pbfio.EntityType) entityKinds {
+	switch t {
+	case pbfio.NodeType:
+		return kindNodes
+	case pbfio.WayType:
+		return kindWays
+	}
+	return kindRelations
+}
+
+// xmlDecoder reads the entities of an OSM XML file one by one.
+type xmlDecoder struct {
+	decoder *xml.Decoder
+
+	// bbox is set, once the bounds element has been read.
+	bbox *pbfproto.HeaderBBox
+
+	// Whether visible attributes or locations of way nodes have been
+	// found so far.
+	historical, locationsOnWays bool
+}
+
+// next returns the next node, way or relation. Other elements are
+// skipped. At the end of the input, io.EOF is returned.
+func (d *xmlDecoder) next() (*pbfio.Entity, error) {
+	var e *pbfio.Entity
+	for {
+		token, err := d.decoder.Token()
+		if err == io.EOF && e != nil {
+			return nil, d.errorf("unexpected end of file")
+		} else if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			err = d.startElement(&e, t)
+		case xml.EndElement:
+			if e != nil && t.Name.Local == e.Type.String() {
+				return e, nil
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (d *xmlDecoder) startElement(e **pbfio.Entity, t xml.StartElement) error {
+	var err error
+	switch name := t.Name.Local; {
+	case name == "osm" && *e == nil:
+		return nil
+	case name == "bounds" && *e == nil:
+		var values [4]int64
+		for i, name := range []string{"minlat", "minlon", "maxlat", "maxlon"} {
+			if values[i], err = d.coordinate(t, name); err != nil {
+				return err
+			}
+		}
+		d.bbox = &pbfproto.HeaderBBox{
+			Bottom: &values[0], Left: &values[1],
+			Top: &values[2], Right: &values[3],
+		}
+		return d.decoder.Skip()
+	case (name == "node" || name == "way" || name == "relation") && *e == nil:
+		*e, err = d.entity(t)
+		return err
+	case name == "tag" && *e != nil:
+		(*e).Tags = append((*e).Tags, pbfio.Tag{Key: attr(t, "k"), Value: attr(t, "v")})
+	case name == "nd" && *e != nil && (*e).Type == pbfio.WayType:
+		return d.nd(*e, t)
+	case name == "member" && *e != nil && (*e).Type == pbfio.RelationType:
+		return d.member(*e, t)
+	default:
+		// Skip unknown elements, like changesets, with their children.
+		return d.decoder.Skip()
+	}
+	return err
+}
+
+func (d *xmlDecoder) entity(t xml.StartElement) (*pbfio.Entity, error) {
+	e := &pbfio.Entity{}
+	switch t.Name.Local {
+	case "node":
+		e.Type = pbfio.NodeType
+	case "way":
+		e.Type = pbfio.WayType
+	case "relation":
+		e.Type = pbfio.RelationType
+	}
+	var err error
+	if e.ID, err = d.int(t, "id", 64); err != nil {
+		return nil, err
+	}
+	if e.Type == pbfio.NodeType && hasAttr(t, "lat") {
+		if e.Lat, err = d.coordinate(t, "lat"); err != nil {
+			return nil, err
+		} else if e.Lon, err = d.coordinate(t, "lon"); err != nil {
+			return nil, err
+		}
+	}
+	if !hasAttr(t, "version") && !hasAttr(t, "timestamp") && !hasAttr(t, "changeset") &&
+		!hasAttr(t, "uid") && !hasAttr(t, "user") && !hasAttr(t, "visible") {
+		return e, nil
+	}
+	e.Info = &pbfio.Info{User: attr(t, "user")}
+	version, err := d.optionalInt(t, "version", 32)
+	if err != nil {
+		return nil, err
+	}
+	e.Info.Version = int32(version)
+	if e.Info.Changeset, err = d.optionalInt(t, "changeset", 64); err != nil {
+		return nil, err
+	}
+	uid, err := d.optionalInt(t, "uid", 32)
+	if err != nil {
+		return nil, err
+	}
+	e.Info.UID = int32(uid)
+	if s := attr(t, "timestamp"); s != "" {
+		ts, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, d.errorf("invalid timestamp '%s'", s)
+		}
+		e.Info.Timestamp = ts.UnixMilli()
+	}
+	if s := attr(t, "visible"); s != "" {
+		visible := s == "true"
+		e.Info.Visible = &visible
+		d.historical = true
+	}
+	return e, nil
+}
+
+func (d *xmlDecoder) nd(e *pbfio.Entity, t xml.StartElement) error {
+	ref, err := d.int(t, "ref", 64)
+	if err != nil {
+		return err
+	}
+	e.Refs = append(e.Refs, ref)
+	if !hasAttr(t, "lat") {
+		if len(e.RefLats) > 0 {
+			e.RefLats = append(e.RefLats, undefinedCoordinate)
+			e.RefLons = append(e.RefLons, undefinedCoordinate)
+		}
+		return nil
+	}
+	lat, err := d.coordinate(t, "lat")
+	if err != nil {
+		return err
+	}
+	lon, err := d.coordinate(t, "lon")
+	if err != nil {
+		return err
+	}
+	// Earlier nodes without location get an undefined one.
+	for len(e.RefLats) < len(e.Refs)-1 {
+		e.RefLats = append(e.RefLats, undefinedCoordinate)
+		e.RefLons = append(e.RefLons, undefinedCoordinate)
+	}
+	e.RefLats = append(e.RefLats, lat)
+	e.RefLons = append(e.RefLons, lon)
+	d.locationsOnWays = true
+	return nil
+}
+
+func (d *xmlDecoder) member(e *pbfio.Entity, t xml.StartElement) error {
+	ref, err := d.int(t, "ref", 64)
+	if err != nil {
+		return err
+	}
+	member := pbfio.Member{ID: ref, Role: attr(t, "role")}
+	switch typ := attr(t, "type"); typ {
+	case "node":
+		member.Type = pbfio.NodeType
+	case "way":
+		member.Type = pbfio.WayType
+	case "relation":
+		member.Type = pbfio.RelationType
+	default:
+		return d.errorf("invalid member type '%s'", typ)
+	}
+	e.Members = append(e.Members, member)
+	return nil
+}
+
+func attr(t xml.StartElement, name string) string {
+	for _, a := range t.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func hasAttr(t xml.StartElement, name string) bool {
+	return slices.ContainsFunc(t.Attr, func(a xml.Attr) bool {
+		return a.Name.Local == name
+	})
+}
+
+func (d *xmlDecoder) int(t xml.StartElement, name string, bitSize int) (int64, error) {
+	s := attr(t, name)
+	v, err := strconv.ParseInt(s, 10, bitSize)
+	if err != nil {
+		return 0, d.errorf("invalid %s '%s' in %s", name, s, t.Name.Local)
+	}
+	return v, nil
+}
+
+func (d *xmlDecoder) optionalInt(t xml.StartElement, name string, bitSize int) (int64, error) {
+	if !hasAttr(t, name) {
+		return 0, nil
+	}
+	return d.int(t, name, bitSize)
+}
+
+// coordinate parses the attribute name, given in degrees, and returns
+// it in nanodegrees. Latitudes must be within ±90, longitudes within
+// ±180 degrees.
+func (d *xmlDecoder) coordinate(t xml.StartElement, name string) (int64, error) {
+	s := attr(t, name)
+	limit := 180.0
+	if strings.HasSuffix(name, "lat") {
+		limit = 90
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || !(math.Abs(v) <= limit) {
+		return 0, d.errorf("invalid %s '%s' in %s", name, s, t.Name.Local)
+	}
+	return int64(math.Round(v * 1e9)), nil
+}
+
+func (d *xmlDecoder) errorf(format string, a ...any) error {
+	line, _ := d.decoder.InputPos()
+	return fmt.Errorf("line %d: %s", line, fmt.Sprintf(format, a...))
+}
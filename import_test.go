@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/codesoap/pbf-reblob/pbfio"
+	"github.com/codesoap/pbf-reblob/pbfproto"
+)
+
+func TestXMLDecoder(t *testing.T) {
+	const input = `<?xml version="1.0"?>
+<osm version="0.6">
+  <bounds minlat="1.5" minlon="2" maxlat="3" maxlon="4.25"/>
+  <changeset id="1"><tag k="a" v="b"/></changeset>
+  <node id="1" version="2" timestamp="2023-11-14T22:13:20Z" changeset="7" uid="5" user="a&amp;b" visible="false"/>
+  <node id="2" lat="-1.5" lon="0.0134"><tag k="name" v="&lt;x&gt;"/></node>
+  <way id="3"><nd ref="1"/><nd ref="2" lat="-1.5" lon="0.0134"/></way>
+  <relation id="4"><member type="way" ref="3" role="outer"/></relation>
+</osm>`
+	visible := false
+	want := []pbfio.Entity{
+		{Type: pbfio.NodeType, ID: 1, Info: &pbfio.Info{
+			Version: 2, Timestamp: 1700000000000, Changeset: 7, UID: 5, User: "a&b", Visible: &visible,
+		}},
+		{Type: pbfio.NodeType, ID: 2, Lat: -1500000000, Lon: 13400000, Tags: []pbfio.Tag{{Key: "name", Value: "<x>"}}},
+		{
+			Type: pbfio.WayType, ID: 3, Refs: []int64{1, 2},
+			RefLats: []int64{undefinedCoordinate, -1500000000}, RefLons: []int64{undefinedCoordinate, 13400000},
+		},
+		{Type: pbfio.RelationType, ID: 4, Members: []pbfio.Member{{Type: pbfio.WayType, ID: 3, Role: "outer"}}},
+	}
+	d := xmlDecoder{decoder: xml.NewDecoder(strings.NewReader(input))}
+	for i := range want {
+		e, err := d.next()
+		if err != nil {
+			t.Fatalf("entity %d: %v", i, err)
+		} else if !reflect.DeepEqual(*e, want[i]) {
+			t.Errorf("entity %d is %+v; want %+v", i, *e, want[i])
+		}
+	}
+	if _, err := d.next(); err != io.EOF {
+		t.Errorf("got %v after the last entity; want io.EOF", err)
+	}
+	if d.bbox == nil || *d.bbox.Left != 2e9 || *d.bbox.Bottom != 1.5e9 || *d.bbox.Right != 4.25e9 || *d.bbox.Top != 3e9 {
+		t.Errorf("bounds are %v", d.bbox)
+	}
+	if !d.historical || !d.locationsOnWays {
+		t.Errorf("historical is %t and locationsOnWays is %t; want both set", d.historical, d.locationsOnWays)
+	}
+}
+
+func TestXMLDecoderCoordinates(t *testing.T) {
+	for _, input := range []string{
+		`<node id="1" lat="90.5" lon="0"/>`,
+		`<node id="1" lat="0" lon="-180.5"/>`,
+		`<node id="1" lat="NaN" lon="0"/>`,
+		`<bounds minlat="-100" minlon="0" maxlat="0" maxlon="0"/>`,
+	} {
+		d := xmlDecoder{decoder: xml.NewDecoder(strings.NewReader(input))}
+		if _, err := d.next(); err == nil || err == io.EOF {
+			t.Errorf("%s: got %v; want an error", input, err)
+		}
+	}
+	d := xmlDecoder{decoder: xml.NewDecoder(strings.NewReader(`<node id="1" lat="-90" lon="180"/>`))}
+	if e, err := d.next(); err != nil || e.Lat != -90e9 || e.Lon != 180e9 {
+		t.Errorf("got %v, %v for the corner of the world", e, err)
+	}
+}
+
+func TestImportXML(t *testing.T) {
+	tests := []struct {
+		name                       string
+		historical, locations      bool
+		sorted                     bool
+		wantRequired, wantOptional []string
+	}{
+		{"plain", false, false, true, nil, []string{sortFeature}},
+		{"history", true, false, true, []string{"HistoricalInformation"}, []string{sortFeature}},
+		{"locations", false, true, true, nil, []string{sortFeature, "LocationsOnWays"}},
+		{"unsorted", false, false, false, nil, nil},
+	}
+	for _, test := range tests {
+		var input strings.Builder
+		input.WriteString(`<osm version="0.6"><bounds minlat="1" minlon="2" maxlat="3" maxlon="4"/>`)
+		visible := ""
+		if test.historical {
+			visible = ` visible="true"`
+		}
+		for id := 1; id <= 2000; id++ {
+			fmt.Fprintf(&input, `<node id="%d" lat="1.5" lon="2.5"%s><tag k="name" v="node %d"/></node>`, id, visible, id)
+		}
+		nd := `<nd ref="1"/>`
+		if test.locations {
+			nd = `<nd ref="1" lat="1.5" lon="2.5"/>`
+		}
+		fmt.Fprintf(&input, `<way id="1">%s</way>`, nd)
+		if !test.sorted {
+			input.WriteString(`<node id="2001" lat="1" lon="2"/>`)
+		}
+		input.WriteString(`</osm>`)
+
+		dir := t.TempDir()
+		cfg := config{
+			inFile:      filepath.Join(dir, "in.osm"),
+			outFile:     filepath.Join(dir, "out.osm.pbf"),
+			compression: "zlib",
+			maxBlobSize: 8 * 1024,
+		}
+		if err := os.WriteFile(cfg.inFile, []byte(input.String()), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := importXML(cfg); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		blobs := make(chan pbfio.DecodedBlob)
+		go pbfio.StreamBlobs(cfg.outFile, pbfio.ReaderOptions{}, blobs)
+		var header *pbfproto.HeaderBlock
+		var dataBlobs, entities int
+		for blob := range blobs {
+			if blob.Err != nil {
+				t.Fatalf("%s: %v", test.name, blob.Err)
+			} else if blob.HeaderBlock != nil {
+				header = blob.HeaderBlock
+				continue
+			}
+			dataBlobs++
+			if size := blob.PrimitiveBlock.SizeVT(); size > cfg.maxBlobSize {
+				t.Errorf("%s: %s has %d bytes; want at most %d", test.name, blob.Position(), size, cfg.maxBlobSize)
+			}
+			blockEntities, err := pbfio.Entities(blob.PrimitiveBlock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entities += len(blockEntities)
+		}
+		if header == nil {
+			t.Fatalf("%s: no OSMHeader", test.name)
+		} else if bbox := header.Bbox; bbox == nil || bbox.GetLeft() != 2e9 || bbox.GetBottom() != 1e9 || bbox.GetRight() != 4e9 || bbox.GetTop() != 3e9 {
+			t.Errorf("%s: got bounding box %v", test.name, bbox)
+		}
+		wantRequired := append([]string{"OsmSchema-V0.6", "DenseNodes"}, test.wantRequired...)
+		if !slices.Equal(header.RequiredFeatures, wantRequired) {
+			t.Errorf("%s: got required features %v; want %v", test.name, header.RequiredFeatures, wantRequired)
+		}
+		// The stamp of the options is not checked here.
+		optional := slices.DeleteFunc(header.OptionalFeatures, func(feature string) bool {
+			return strings.HasPrefix(feature, "pbf-reblob:")
+		})
+		if !slices.Equal(optional, test.wantOptional) {
+			t.Errorf("%s: got optional features %v; want %v", test.name, optional, test.wantOptional)
+		}
+		if dataBlobs < 2 {
+			t.Errorf("%s: got %d data blobs; want several", test.name, dataBlobs)
+		}
+		wantEntities := 2001
+		if !test.sorted {
+			wantEntities++
+		}
+		if entities != wantEntities {
+			t.Errorf("%s: got %d entities; want %d", test.name, entities, wantEntities)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/codesoap/pbf-reblob/pbfio"
+)
+
+func runIndex(args []string) {
+	flags := flag.NewFlagSet("index", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr,
+			"Usage:\n  pbf-reblob index [-v] [-r] <IN_FILE> [<INDEX_FILE>]")
+		fmt.Fprintln(os.Stderr, "The default INDEX_FILE is IN_FILE with the suffix '.idx'.")
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+	}
+	verbose := flags.Bool("v", false, "verbose")
+	resync := flags.Bool("r", false, "skip damaged regions of the input file instead of aborting")
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	inFile := flags.Arg(0)
+	indexFile := inFile + ".idx"
+	if flags.NArg() == 2 {
+		indexFile = flags.Arg(1)
+	}
+	if _, err := os.Stat(indexFile); !errors.Is(err, os.ErrNotExist) {
+		fmt.Fprintf(os.Stderr, "The file '%s' already exists.\n", indexFile)
+		os.Exit(1)
+	}
+
+	readerOpts := pbfio.ReaderOptions{
+		Resync: *resync,
+		Warn: func(err error) {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		},
+	}
+	entries, err := pbfio.BuildIndex(inFile, readerOpts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Could not index '%s': %v\n", inFile, err)
+		os.Exit(1)
+	}
+	if err = writeIndexFile(indexFile, entries); err != nil {
+		os.Remove(indexFile)
+		fmt.Fprintf(os.Stderr, "Error: Could not write index: %v\n", err)
+		os.Exit(1)
+	}
+	if *verbose {
+		log.Printf("Info: Indexed %d blobs", len(entries))
+	}
+}
+
+func writeIndexFile(indexFile string, entries []pbfio.IndexEntry) error {
+	file, err := os.Create(indexFile)
+	if err != nil {
+		return err
+	}
+	if err = pbfio.WriteIndex(file, entries); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/codesoap/pbf-reblob/pbfio"
+	"github.com/codesoap/pbf-reblob/pbfproto"
+)
+
+type blobStats struct {
+	count                    int
+	dataSize, rawSize        int64
+	minRawSize, maxRawSize   int
+	countByType              map[string]int
+	countByCompression       map[string]int
+	typeOrder, compressOrder []string
+}
+
+func runInfo(args []string) {
+	flags := flag.NewFlagSet("info", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:\n  pbf-reblob info <IN_FILE>")
+		fmt.Fprintln(os.Stderr, "Only the OSMHeader is decompressed, so this is fast even for huge files.")
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	inFile := flags.Arg(0)
+	file, err := os.Open(inFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Could not open in file '%s': %v\n", inFile, err)
+		os.Exit(1)
+	}
+	defer file.Close()
+	if err = printHeader(os.Stdout, file); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Could not read OSMHeader of '%s': %v\n", inFile, err)
+		os.Exit(1)
+	}
+	stats, err := collectBlobStats(pbfio.NewBlobScanner(file))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Could not scan '%s': %v\n", inFile, err)
+		os.Exit(1)
+	}
+	stats.print(os.Stdout)
+}
+
+// printHeader prints the fields of the HeaderBlock of file, if the
+// first blob is an OSMHeader.
+func printHeader(w io.Writer, file *os.File) error {
+	reader := pbfio.NewBlobReader(file)
+	defer reader.Close()
+	blob, err := reader.ReadBlob(0)
+	if err != nil {
+		return err
+	} else if blob.HeaderBlock == nil {
+		return nil
+	}
+	h := blob.HeaderBlock
+	if h.Writingprogram != nil {
+		fmt.Fprintf(w, "Writing program:      %s\n", h.GetWritingprogram())
+	}
+	if h.Source != nil {
+		fmt.Fprintf(w, "Source:               %s\n", h.GetSource())
+	}
+	fmt.Fprintf(w, "Required features:    %s\n", strings.Join(h.RequiredFeatures, ", "))
+	if len(h.OptionalFeatures) > 0 {
+		fmt.Fprintf(w, "Optional features:    %s\n", strings.Join(h.OptionalFeatures, ", "))
+	}
+	if h.Bbox != nil {
+		fmt.Fprintf(w, "Bounding box:         %s\n", formatBBox(h.Bbox))
+	}
+	if h.OsmosisReplicationTimestamp != nil {
+		ts := time.Unix(h.GetOsmosisReplicationTimestamp(), 0).UTC()
+		fmt.Fprintf(w, "Replication time:     %s\n", ts.Format(time.RFC3339))
+	}
+	if h.OsmosisReplicationSequenceNumber != nil {
+		fmt.Fprintf(w, "Replication sequence: %d\n", h.GetOsmosisReplicationSequenceNumber())
+	}
+	if h.OsmosisReplicationBaseUrl != nil {
+		fmt.Fprintf(w, "Replication URL:      %s\n", h.GetOsmosisReplicationBaseUrl())
+	}
+	return nil
+}
+
+// formatBBox formats bbox in degrees as left,bottom,right,top, like
+// osmium does.
+func formatBBox(bbox *pbfproto.HeaderBBox) string {
+	return fmt.Sprintf("%.7f,%.7f,%.7f,%.7f",
+		float64(bbox.GetLeft())/1e9, float64(bbox.GetBottom())/1e9,
+		float64(bbox.GetRight())/1e9, float64(bbox.GetTop())/1e9)
+}
+
+func collectBlobStats(scanner *pbfio.BlobScanner) (blobStats, error) {
+	stats := blobStats{
+		countByType:        make(map[string]int),
+		countByCompression: make(map[string]int),
+	}
+	for {
+		info, err := scanner.Next()
+		if err == io.EOF {
+			return stats, nil
+		} else if err != nil {
+			return stats, err
+		}
+		stats.count++
+		stats.dataSize += int64(info.DataSize)
+		stats.rawSize += int64(info.RawSize)
+		if stats.count == 1 || info.RawSize < stats.minRawSize {
+			stats.minRawSize = info.RawSize
+		}
+		if info.RawSize > stats.maxRawSize {
+			stats.maxRawSize = info.RawSize
+		}
+		typ := info.BlobHeader.GetType()
+		if !slices.Contains(stats.typeOrder, typ) {
+			stats.typeOrder = append(stats.typeOrder, typ)
+		}
+		stats.countByType[typ]++
+		if !slices.Contains(stats.compressOrder, info.Compression) {
+			stats.compressOrder = append(stats.compressOrder, info.Compression)
+		}
+		stats.countByCompression[info.Compression]++
+	}
+}
+
+func (s blobStats) print(w io.Writer) {
+	fmt.Fprintf(w, "Blobs:                %d\n", s.count)
+	for _, typ := range s.typeOrder {
+		fmt.Fprintf(w, "  %-19s %d\n", typ+":", s.countByType[typ])
+	}
+	fmt.Fprintln(w, "Compression:")
+	for _, compression := range s.compressOrder {
+		fmt.Fprintf(w, "  %-19s %d\n", compression+":", s.countByCompression[compression])
+	}
+	fmt.Fprintf(w, "Compressed size:      %2.3f MiB\n", float64(s.dataSize)/1024/1024)
+	fmt.Fprintf(w, "Raw size:             %2.3f MiB\n", float64(s.rawSize)/1024/1024)
+	if s.count > 0 {
+		fmt.Fprintf(w, "Raw blob size:        %2.3f MiB min, %2.3f MiB avg, %2.3f MiB max\n",
+			float64(s.minRawSize)/1024/1024,
+			float64(s.rawSize)/float64(s.count)/1024/1024,
+			float64(s.maxRawSize)/1024/1024)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/codesoap/pbf-reblob/pbfio"
+	"github.com/codesoap/pbf-reblob/pbfproto"
+)
+
+// undefinedCoordinate is stored for nodes with unknown location. Like
+// in osmium, it is the largest int32 in units of 100 nanodegrees.
+const undefinedCoordinate = (1<<31 - 1) * 100
+
+// knownLocation reports whether lat is a valid latitude. This is not the
+// case for undefinedCoordinate, even if it was rounded to the units of a
+// block.
+func knownLocation(lat int64) bool {
+	return lat >= -90e9 && lat <= 90e9
+}
+
+// locationStore maps node IDs to locations in nanodegrees. Locations
+// are stored with a precision of 100 nanodegrees.
+type locationStore interface {
+	set(id, lat, lon int64) error
+	get(id int64) (lat, lon int64, ok bool)
+	close() error
+}
+
+func newLocationStore(cfg config) (locationStore, error) {
+	switch cfg.locationStore {
+	case "sparse":
+		return &sparseStore{}, nil
+	case "dense":
+		return newDenseStore(filepath.Dir(cfg.outFile))
+	}
+	return nil, fmt.Errorf("unknown location store '%s'", cfg.locationStore)
+}
+
+// packLocation packs a location into 64 bits. The result is never 0,
+// so that 0 can mark unknown locations.
+func packLocation(lat, lon int64) uint64 {
+	return uint64(uint32(roundDiv(lat, 100)+900000001))<<32 | uint64(uint32(int32(roundDiv(lon, 100))))
+}
+
+func unpackLocation(loc uint64) (lat, lon int64) {
+	return (int64(loc>>32) - 900000001) * 100, int64(int32(uint32(loc))) * 100
+}
+
+// roundDiv divides a by b, rounding to the nearest integer.
+func roundDiv(a, b int64) int64 {
+	if a < 0 {
+		return -((-a + b/2) / b)
+	}
+	return (a + b/2) / b
+}
+
+// sparseStore keeps the locations of all nodes in memory, using 16
+// bytes per node. The nodes are sorted by ID once, when the first
+// location is requested. Afterwards, only nodes with higher IDs can be
+// added.
+type sparseStore struct {
+	nodes            []nodeLocation
+	unsorted, sorted bool
+}
+
+type nodeLocation struct {
+	id  int64
+	loc uint64
+}
+
+func (s *sparseStore) set(id, lat, lon int64) error {
+	if len(s.nodes) > 0 && id < s.nodes[len(s.nodes)-1].id {
+		if s.sorted {
+			return fmt.Errorf("node %d follows ways and nodes with higher IDs; the input must be sorted by type, or the dense location store be used", id)
+		}
+		s.unsorted = true
+	}
+	s.nodes = append(s.nodes, nodeLocation{id: id, loc: packLocation(lat, lon)})
+	return nil
+}
+
+func (s *sparseStore) get(id int64) (lat, lon int64, ok bool) {
+	if !s.sorted {
+		if s.unsorted {
+			slices.SortStableFunc(s.nodes, func(a, b nodeLocation) int {
+				return cmp.Compare(a.id, b.id)
+			})
+		}
+		s.sorted = true
+	}
+	i, ok := slices.BinarySearchFunc(s.nodes, id, func(n nodeLocation, id int64) int {
+		return cmp.Compare(n.id, id)
+	})
+	if !ok {
+		return 0, 0, false
+	}
+	// With duplicate IDs, e.g. in history files, use the last location.
+	for i+1 < len(s.nodes) && s.nodes[i+1].id == id {
+		i++
+	}
+	lat, lon = unpackLocation(s.nodes[i].loc)
+	return lat, lon, true
+}
+
+func (s *sparseStore) close() error {
+	s.nodes = nil
+	return nil
+}
+
+// denseStore keeps locations in a memory-mapped temporary file, using 8
+// bytes per possible node ID. The file is sparse, so only the pages of
+// actually used IDs need disk space.
+type denseStore struct {
+	file *os.File
+	data []byte
+}
+
+func newDenseStore(dir string) (*denseStore, error) {
+	file, err := os.CreateTemp(dir, ".pbf-reblob-locations-")
+	if err != nil {
+		return nil, err
+	}
+	// The file is not needed after the program exits, even if it
+	// crashes.
+	os.Remove(file.Name())
+	return &denseStore{file: file}, nil
+}
+
+func (s *denseStore) set(id, lat, lon int64) error {
+	if id < 0 {
+		return fmt.Errorf("cannot store location of node with negative ID %d", id)
+	}
+	if need := (id + 1) * 8; need > int64(len(s.data)) {
+		size := max(need, 2*int64(len(s.data)), 1<<30)
+		if err := s.grow(size); err != nil {
+			return fmt.Errorf("could not grow location store: %v", err)
+		}
+	}
+	binary.LittleEndian.PutUint64(s.data[id*8:], packLocation(lat, lon))
+	return nil
+}
+
+func (s *denseStore) get(id int64) (lat, lon int64, ok bool) {
+	if id < 0 || (id+1)*8 > int64(len(s.data)) {
+		return 0, 0, false
+	}
+	loc := binary.LittleEndian.Uint64(s.data[id*8:])
+	if loc == 0 {
+		return 0, 0, false
+	}
+	lat, lon = unpackLocation(loc)
+	return lat, lon, true
+}
+
+func (s *denseStore) grow(size int64) error {
+	if err := s.file.Truncate(size); err != nil {
+		return err
+	}
+	if s.data != nil {
+		if err := munmap(s.data); err != nil {
+			return err
+		}
+		s.data = nil
+	}
+	data, err := mmap(s.file, size)
+	if err != nil {
+		return err
+	}
+	s.data = data
+	return nil
+}
+
+func (s *denseStore) close() error {
+	if s.data != nil {
+		munmap(s.data)
+		s.data = nil
+	}
+	return s.file.Close()
+}
+
+// locationAdder stores the locations of nodes and adds them to the ways,
+// that follow them.
+type locationAdder struct {
+	store   locationStore
+	missing int // The amount of way nodes with unknown location.
+}
+
+// stream returns a channel, which receives the blobs of blobsIn with
+// node locations added to their ways. It is closed after blobsIn.
+func (a *locationAdder) stream(blobsIn chan pbfio.DecodedBlob) chan pbfio.DecodedBlob {
+	blobsOut := make(chan pbfio.DecodedBlob)
+	go func() {
+		defer close(blobsOut)
+		for blob := range blobsIn {
+			if blob.Err == nil && blob.PrimitiveBlock != nil {
+				if err := a.addToBlock(blob.PrimitiveBlock); err != nil {
+					blob.Err = fmt.Errorf("%s: %v", blob.Position(), err)
+				} else if blockKinds(blob.PrimitiveBlock)&kindWays != 0 {
+					blob.RawBlob = nil
+				}
+			}
+			blobsOut <- blob
+		}
+	}()
+	return blobsOut
+}
+
+// addToBlock stores the locations of the nodes of block and sets the
+// locations of the nodes of its ways.
+func (a *locationAdder) addToBlock(block *pbfproto.PrimitiveBlock) error {
+	granularity := int64(block.GetGranularity())
+	latOffset, lonOffset := block.GetLatOffset(), block.GetLonOffset()
+	for _, group := range block.Primitivegroup {
+		for _, node := range group.Nodes {
+			lat := latOffset + granularity*node.GetLat()
+			lon := lonOffset + granularity*node.GetLon()
+			if err := a.store.set(node.GetId(), lat, lon); err != nil {
+				return err
+			}
+		}
+		if dense := group.Dense; dense != nil {
+			var id, lat, lon int64
+			for i := range min(len(dense.Id), len(dense.Lat), len(dense.Lon)) {
+				id += dense.Id[i]
+				lat += dense.Lat[i]
+				lon += dense.Lon[i]
+				err := a.store.set(id, latOffset+granularity*lat, lonOffset+granularity*lon)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		for _, way := range group.Ways {
+			way.Lat = slices.Grow(way.Lat[:0], len(way.Refs))
+			way.Lon = slices.Grow(way.Lon[:0], len(way.Refs))
+			var ref, prevLat, prevLon int64
+			for _, delta := range way.Refs {
+				ref += delta
+				lat, lon := a.location(ref)
+				lat = roundDiv(lat-latOffset, granularity)
+				lon = roundDiv(lon-lonOffset, granularity)
+				way.Lat = append(way.Lat, lat-prevLat)
+				way.Lon = append(way.Lon, lon-prevLon)
+				prevLat, prevLon = lat, lon
+			}
+		}
+	}
+	return nil
+}
+
+// addToEntity stores the location of e, if it is a node, or sets the
+// locations of its nodes, if it is a way.
+func (a *locationAdder) addToEntity(e *pbfio.Entity) error {
+	switch e.Type {
+	case pbfio.NodeType:
+		return a.store.set(e.ID, e.Lat, e.Lon)
+	case pbfio.WayType:
+		e.RefLats = make([]int64, len(e.Refs))
+		e.RefLons = make([]int64, len(e.Refs))
+		for i, ref := range e.Refs {
+			e.RefLats[i], e.RefLons[i] = a.location(ref)
+		}
+	}
+	return nil
+}
+
+func (a *locationAdder) location(id int64) (lat, lon int64) {
+	lat, lon, ok := a.store.get(id)
+	if !ok {
+		a.missing++
+		return undefinedCoordinate, undefinedCoordinate
+	}
+	return lat, lon
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/codesoap/pbf-reblob/pbfio"
+	"github.com/codesoap/pbf-reblob/pbfproto"
+)
+
+func TestLocationStores(t *testing.T) {
+	dense, err := newDenseStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dense.close()
+	for name, store := range map[string]locationStore{"sparse": &sparseStore{}, "dense": dense} {
+		locations := [][3]int64{
+			{5, 0, 0}, {2, -900000000 * 100, -1800000000 * 100}, {9, 515000000, -1200}, {5, 100, 200},
+		}
+		for _, l := range locations {
+			if err := store.set(l[0], l[1], l[2]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, want := range locations[1:] {
+			if lat, lon, ok := store.get(want[0]); !ok || lat != want[1] || lon != want[2] {
+				t.Errorf("%s: got %d,%d,%t for node %d, want %d,%d", name, lat, lon, ok, want[0], want[1], want[2])
+			}
+		}
+		if _, _, ok := store.get(3); ok {
+			t.Errorf("%s: found location of unknown node", name)
+		}
+	}
+}
+
+func TestAddToBlock(t *testing.T) {
+	// Node 2 is stored with 100 nanodegrees precision, but its
+	// location must still convert to the units of the block exactly.
+	granularity, latOffset, lonOffset := int32(1000), int64(550), int64(-300)
+	block := &pbfproto.PrimitiveBlock{
+		Stringtable: &pbfproto.StringTable{S: [][]byte{{}}},
+		Granularity: &granularity,
+		LatOffset:   &latOffset,
+		LonOffset:   &lonOffset,
+		Primitivegroup: []*pbfproto.PrimitiveGroup{
+			{Dense: &pbfproto.DenseNodes{Id: []int64{1, 1}, Lat: []int64{7, -10}, Lon: []int64{-2, 4}, KeysVals: []int32{0, 0}}},
+			{Ways: []*pbfproto.Way{{Id: ptr(int64(10)), Refs: []int64{1, 2, -1}}}},
+		},
+	}
+	a := locationAdder{store: &sparseStore{}}
+	if err := a.addToBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	entities, err := pbfio.Entities(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	way := entities[2]
+	wantLats := []int64{550 + 7000, undefinedCoordinate, 550 - 3000}
+	wantLons := []int64{-300 - 2000, undefinedCoordinate, -300 + 2000}
+	for i := range way.Refs {
+		if known := knownLocation(way.RefLats[i]); known != (wantLats[i] != undefinedCoordinate) {
+			t.Errorf("location %d of the way is known: %t", i, known)
+		} else if known && (way.RefLats[i] != wantLats[i] || way.RefLons[i] != wantLons[i]) {
+			t.Errorf("location %d of the way is %d,%d, want %d,%d", i, way.RefLats[i], way.RefLons[i], wantLats[i], wantLons[i])
+		}
+	}
+	if a.missing != 1 {
+		t.Errorf("got %d missing locations, want 1", a.missing)
+	}
+}
+
+func TestSparseStoreOrder(t *testing.T) {
+	s := &sparseStore{}
+	for _, id := range []int64{5, 3, 8} {
+		if err := s.set(id, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, ok := s.get(3); !ok {
+		t.Errorf("location of node 3 not found")
+	}
+	if err := s.set(9, 0, 0); err != nil {
+		t.Errorf("could not add a node with higher ID: %v", err)
+	}
+	if err := s.set(4, 0, 0); err == nil {
+		t.Errorf("added a node with lower ID after reading locations")
+	}
+}
@@ -6,30 +6,94 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"slices"
 	"strconv"
 
+	"github.com/codesoap/lineworker"
 	"github.com/codesoap/pbf-reblob/pbfio"
 )
 
+// runSizeFactor determines the raw size of the runs of input blobs,
+// that are merged concurrently, relative to the blob size limit.
+const runSizeFactor = 4
+
 type config struct {
 	maxBlobSize     int
 	verbose         bool
+	resync          bool
+	indexData       bool
+	passThrough     bool
+	jobs            int
+	window          int
+	sameKind        bool
+	recomputeBBox   bool
+	stamp           bool
+	requireSorted   bool
+	sort            bool
+	sortMemory      int
+	cluster         string
+	locationsOnWays bool // Whether the input has the LocationsOnWays feature.
+	addLocations    bool
+	locationStore   string
+	omitMetadata    bool
+	tagFilter       tagFilter
+	entityFilter    entityFilter
+	extract         *extractor // Only set by the extract command.
+	headerEdits     headerEdits
 	inFile, outFile string
 	compression     string
 }
 
-func readFlags(cfg *config) {
+// readFlags parses args into cfg. If cfg.extract is set, the options of
+// the extract command are accepted as well.
+func readFlags(cfg *config, args []string) {
 	flag.Usage = func() {
+		if cfg.extract != nil {
+			fmt.Fprintln(os.Stderr, "Usage:\n  pbf-reblob extract (-bbox <BBOX> | -polygon <FILE>) [<OPTIONS>] <IN_FILE> <OUT_FILE>")
+			fmt.Fprintln(os.Stderr, "The input must be sorted by type. All options of reblobbing are accepted.")
+			fmt.Fprintln(os.Stderr, "Options:")
+			flag.PrintDefaults()
+			return
+		}
 		fmt.Fprintln(os.Stderr,
-			"Usage:\n  pbf-reblob [-v] [-s <size>] [-c <compression>] <IN_FILE> <OUT_FILE>")
+			"Usage:\n  pbf-reblob [<OPTIONS>] <IN_FILE> <OUT_FILE>\n"+
+				"  pbf-reblob extract (-bbox <BBOX> | -polygon <FILE>) [<OPTIONS>] <IN_FILE> <OUT_FILE>\n"+
+				"  pbf-reblob header [<OPTIONS>] <IN_FILE> <OUT_FILE>\n"+
+				"  pbf-reblob index [-v] [-r] <IN_FILE> [<INDEX_FILE>]\n"+
+				"  pbf-reblob info <IN_FILE>\n"+
+				"  pbf-reblob cat [-format xml] [-blobs <RANGE> | -r] <IN_FILE>\n"+
+				"  pbf-reblob import [<OPTIONS>] <IN_FILE> <OUT_FILE>")
+		fmt.Fprintln(os.Stderr, "Options, that edit the OSMHeader, remove a field if an empty value is given.")
 		fmt.Fprintln(os.Stderr, "Options:")
 		flag.PrintDefaults()
 	}
 	flag.BoolVar(&cfg.verbose, "v", false, "verbose")
+	flag.BoolVar(&cfg.resync, "r", false, "skip damaged regions of the input file instead of aborting")
+	flag.BoolVar(&cfg.indexData, "i", false, "store entity types, ID ranges and bounding box in each BlobHeader")
+	flag.BoolVar(&cfg.passThrough, "p", false, "copy blobs that need no merging without recompressing them")
+	flag.BoolVar(&cfg.sameKind, "t", false, "don't mix entity types in one blob")
+	flag.BoolVar(&cfg.recomputeBBox, "recompute-bbox", false, "compute the bounding box in the OSMHeader from the data; reads the input twice")
 	flag.StringVar(&cfg.compression, "c", "zlib", "output compression; either 'raw', 'zlib' or 'zstd'")
+	flag.IntVar(&cfg.jobs, "j", 1, "amount of concurrent merge jobs; more than 1 produces slightly more blobs")
+	flag.IntVar(&cfg.window, "w", 0, "plan this many output blobs ahead, to fill them evenly")
 	sizep := flag.String("s", "16M", "uncompressed blob size limit; suffixes 'k' and 'M' allowed")
-	flag.Parse()
+	flag.BoolVar(&cfg.stamp, "stamp", false, "set the writing program in the OSMHeader to pbf-reblob and record the blob size and compression")
+	flag.BoolVar(&cfg.requireSorted, "require-sorted", false, "abort if the input is not sorted by type, then ID")
+	flag.BoolVar(&cfg.sort, "sort", false, "sort entities by type, then ID; uses temporary files next to OUT_FILE")
+	flag.StringVar(&cfg.cluster, "cluster", "", "sort entities by location, for better string reuse within blobs; either 'nodes' or 'ways', which clusters nodes and ways")
+	sortMemoryp := flag.String("sort-memory", "1G", "memory budget for sorting; suffixes 'k', 'M' and 'G' allowed")
+	flag.BoolVar(&cfg.addLocations, "add-locations", false, "add node locations to ways and set the LocationsOnWays feature")
+	flag.StringVar(&cfg.locationStore, "location-store", "sparse", "node location store; either 'sparse', which is kept in memory, or 'dense', a memory-mapped file next to OUT_FILE for huge inputs")
+	flag.BoolVar(&cfg.omitMetadata, "omit-metadata", false, "drop version, timestamp, changeset and user of all entities")
+	cfg.entityFilter.register(flag.CommandLine)
+	cfg.tagFilter.register(flag.CommandLine)
+	cfg.headerEdits.register(flag.CommandLine)
+	if cfg.extract != nil {
+		cfg.extract.register(flag.CommandLine)
+	}
+	flag.CommandLine.Parse(args)
 	size := *sizep
+	sortMemory := *sortMemoryp
 
 	if flag.NArg() != 2 {
 		flag.Usage()
@@ -42,16 +106,49 @@ func readFlags(cfg *config) {
 		os.Exit(1)
 	}
 
+	if cfg.jobs < 1 {
+		fmt.Fprintln(os.Stderr, "Error: At least one job is needed.")
+		os.Exit(1)
+	} else if cfg.window < 0 {
+		fmt.Fprintln(os.Stderr, "Error: The window must not be negative.")
+		os.Exit(1)
+	}
 	if cfg.compression != "raw" &&
 		cfg.compression != "zlib" &&
-		cfg.compression != "zstd" {
+		cfg.compression != "zstd" ||
+		cfg.locationStore != "sparse" &&
+			cfg.locationStore != "dense" ||
+		cfg.cluster != "" &&
+			cfg.cluster != "nodes" &&
+			cfg.cluster != "ways" {
 		flag.Usage()
 		os.Exit(1)
 	}
 	setMaxBlobSize(cfg, size)
+	if cfg.extract != nil {
+		if err := cfg.extract.setup(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		} else if cfg.recomputeBBox {
+			fmt.Fprintln(os.Stderr, "Warning: -recompute-bbox has no effect when extracting; the bounding box of the region and the kept nodes is used.")
+			cfg.recomputeBBox = false
+		}
+	}
+	if cfg.cluster != "" {
+		// Clustering is done by sorting by location.
+		cfg.sort = true
+	}
+	if cfg.sort {
+		cfg.sortMemory = mustParseSize(sortMemory)
+		if cfg.jobs > 1 || cfg.window > 0 {
+			fmt.Fprintln(os.Stderr, "Warning: -j and -w have no effect when sorting or clustering.")
+		}
+	}
 }
 
-func setMaxBlobSize(cfg *config, size string) {
+// mustParseSize parses a size, that may have one of the suffixes 'k',
+// 'M' or 'G'. On failure, the program is exited.
+func mustParseSize(size string) int {
 	if size == "" {
 		fmt.Fprintln(os.Stderr, "Error: Empty size given.")
 		os.Exit(1)
@@ -64,14 +161,21 @@ func setMaxBlobSize(cfg *config, size string) {
 	} else if lastChar == 'm' || lastChar == 'M' {
 		mult = 1024 * 1024
 		size = size[:len(size)-1]
+	} else if lastChar == 'g' || lastChar == 'G' {
+		mult = 1024 * 1024 * 1024
+		size = size[:len(size)-1]
 	}
-	var err error
-	if cfg.maxBlobSize, err = strconv.Atoi(size); err != nil {
+	n, err := strconv.Atoi(size)
+	if err != nil {
 		format := "Error: Could not understand given size '%s': %v\n"
 		fmt.Fprintf(os.Stderr, format, size, err)
 		os.Exit(1)
 	}
-	cfg.maxBlobSize *= mult
+	return n * mult
+}
+
+func setMaxBlobSize(cfg *config, size string) {
+	cfg.maxBlobSize = mustParseSize(size)
 	if cfg.maxBlobSize < 1024 {
 		format := "Error: Size %d is too small. Use at least 1024.\n"
 		fmt.Fprintf(os.Stderr, format, cfg.maxBlobSize)
@@ -84,15 +188,46 @@ func setMaxBlobSize(cfg *config, size string) {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "index":
+			runIndex(os.Args[2:])
+			return
+		case "info":
+			runInfo(os.Args[2:])
+			return
+		case "cat":
+			runCat(os.Args[2:])
+			return
+		case "import":
+			runImport(os.Args[2:])
+			return
+		case "header":
+			runHeader(os.Args[2:])
+			return
+		case "extract":
+			cfg := config{extract: &extractor{}}
+			readFlags(&cfg, os.Args[2:])
+			reblob(cfg)
+			return
+		}
+	}
 	var cfg config
-	readFlags(&cfg)
+	readFlags(&cfg, os.Args[1:])
 	reblob(cfg)
 }
 
 func reblob(cfg config) {
 	// FIXME: os.Exit ignores defers
 	blobsIn := make(chan pbfio.DecodedBlob)
-	go pbfio.StreamBlobs(cfg.inFile, blobsIn)
+	readerOpts := pbfio.ReaderOptions{
+		Resync:  cfg.resync,
+		KeepRaw: cfg.passThrough,
+		Warn: func(err error) {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		},
+	}
+	go pbfio.StreamBlobs(cfg.inFile, readerOpts, blobsIn)
 	osmHeader, ok := <-blobsIn
 	if !ok {
 		fmt.Fprintln(os.Stderr, "Error: Could not read OSMHeader blob.")
@@ -103,10 +238,107 @@ func reblob(cfg config) {
 		fmt.Fprintf(os.Stderr, "Error: Invalid OSMHeader: %v\n", err)
 		os.Exit(1)
 	}
+	if cfg.omitMetadata && slices.Contains(osmHeader.HeaderBlock.RequiredFeatures, "HistoricalInformation") {
+		fmt.Fprintln(os.Stderr, "Error: Metadata cannot be omitted from history files, because old and deleted versions would look like current ones.")
+		os.Exit(1)
+	}
+	cfg.locationsOnWays = slices.Contains(osmHeader.HeaderBlock.RequiredFeatures, "LocationsOnWays") ||
+		slices.Contains(osmHeader.HeaderBlock.OptionalFeatures, "LocationsOnWays")
+	if cfg.sort {
+		h := osmHeader.HeaderBlock
+		if !slices.Contains(h.RequiredFeatures, "DenseNodes") {
+			h.RequiredFeatures = append(h.RequiredFeatures, "DenseNodes")
+		}
+		if cfg.cluster != "" {
+			h.OptionalFeatures = slices.DeleteFunc(h.OptionalFeatures, func(feature string) bool {
+				return feature == sortFeature
+			})
+		} else if !slices.Contains(h.OptionalFeatures, sortFeature) {
+			h.OptionalFeatures = append(h.OptionalFeatures, sortFeature)
+		}
+		osmHeader.RawBlob = nil
+	}
+	if cfg.cluster == "ways" && !cfg.locationsOnWays && !cfg.addLocations {
+		fmt.Fprintln(os.Stderr, "Error: Clustering ways needs node locations on ways; use -add-locations.")
+		os.Exit(1)
+	}
+	var locations *locationAdder
+	if cfg.addLocations {
+		store, err := newLocationStore(cfg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not create location store: %v\n", err)
+			os.Exit(1)
+		}
+		defer store.close()
+		locations = &locationAdder{store: store}
+		if !cfg.sort {
+			blobsIn = locations.stream(blobsIn)
+		}
+		h := osmHeader.HeaderBlock
+		if !slices.Contains(h.OptionalFeatures, "LocationsOnWays") &&
+			!slices.Contains(h.RequiredFeatures, "LocationsOnWays") {
+			h.OptionalFeatures = append(h.OptionalFeatures, "LocationsOnWays")
+		}
+		osmHeader.RawBlob = nil
+	}
+	if cfg.extract != nil {
+		if err := cfg.extract.collect(cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not collect entities to extract: %v\n", err)
+			os.Exit(1)
+		}
+		blobsIn = filterEntities(blobsIn, cfg.extract.keeps)
+		osmHeader.HeaderBlock.Bbox = cfg.extract.headerBBox()
+		osmHeader.RawBlob = nil
+	}
+	if cfg.entityFilter.active() {
+		if cfg.entityFilter.references {
+			if err := cfg.entityFilter.collectReferences(cfg); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: Could not collect referenced entities: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		blobsIn = filterEntities(blobsIn, cfg.entityFilter.keeps)
+	}
+	if cfg.recomputeBBox {
+		// Only the locations of the kept entities are written.
+		var keeps func(e *pbfio.Entity) bool
+		if cfg.entityFilter.active() {
+			keeps = cfg.entityFilter.keeps
+		}
+		bbox, err := computeBBox(cfg, keeps)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not compute bounding box: %v\n", err)
+			os.Exit(1)
+		} else if bbox == nil && cfg.verbose {
+			log.Printf("Info: Output contains no locations; removing bounding box")
+		}
+		osmHeader.HeaderBlock.Bbox = bbox
+		osmHeader.RawBlob = nil
+	}
+	if cfg.tagFilter.active() {
+		blobsIn = transformBlocks(blobsIn, cfg.tagFilter.apply)
+	}
+	if cfg.omitMetadata {
+		blobsIn = transformBlocks(blobsIn, omitMetadata)
+	}
+	if cfg.stamp {
+		stamp(osmHeader.HeaderBlock, cfg)
+		osmHeader.RawBlob = nil
+	}
+	if len(cfg.headerEdits) > 0 {
+		cfg.headerEdits.apply(osmHeader.HeaderBlock)
+		osmHeader.RawBlob = nil
+	}
+	claimsSorted := slices.Contains(osmHeader.HeaderBlock.OptionalFeatures, sortFeature)
 
 	blobsOut := make(chan pbfio.DecodedBlob)
 	errs := make(chan error)
-	go pbfio.WriteBlobs(cfg.outFile, cfg.compression, blobsOut, errs)
+	writerOpts := pbfio.WriterOptions{
+		Compression: cfg.compression,
+		IndexData:   cfg.indexData,
+		PassThrough: cfg.passThrough,
+	}
+	go pbfio.WriteBlobs(cfg.outFile, writerOpts, blobsOut, errs)
 	success := false
 	defer func() {
 		if !success {
@@ -115,40 +347,155 @@ func reblob(cfg config) {
 	}()
 	blobsOut <- osmHeader
 
-	var outBlob *pbfio.DecodedBlob
+	var stats outputStats
+	if cfg.sort {
+		err = sortBlobs(cfg, blobsIn, blobsOut, errs, &stats, locations)
+	} else if cfg.jobs > 1 {
+		err = mergeConcurrently(cfg, blobsIn, blobsOut, errs, &stats)
+	} else {
+		err = mergeSequentially(cfg, blobsIn, blobsOut, errs, &stats)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Could not reblob: %v\n", err)
+		os.Exit(1)
+	}
+	close(blobsOut)
+	if err, ok := <-errs; ok {
+		fmt.Fprintf(os.Stderr, "Error: Could not write blob: %v\n", err)
+		os.Exit(1)
+	}
+	if locations != nil && locations.missing > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: The locations of %d way nodes are unknown.\n", locations.missing)
+	}
+	if claimsSorted && stats.order.unsorted {
+		fmt.Fprintf(os.Stderr, "Warning: The input is not sorted by type and ID, although its header claims so.\n")
+		if err = dropSortFeature(cfg.outFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not remove %s from the OSMHeader: %v\n", sortFeature, err)
+			os.Exit(1)
+		}
+	}
+	success = true
+	if cfg.verbose && stats.blobs > 0 {
+		log.Printf("Info: Wrote %d data blobs with an average fill ratio of %.1f%%",
+			stats.blobs, 100*float64(stats.rawSize)/float64(stats.blobs)/float64(cfg.maxBlobSize))
+	}
+}
+
+// outputStats collects the sizes of the written data blobs and the
+// order of their entities.
+type outputStats struct {
+	blobs   int
+	rawSize int64
+	order   sortChecker
+}
+
+// mergeSequentially merges all blobs from blobsIn with a single merger.
+func mergeSequentially(cfg config, blobsIn chan pbfio.DecodedBlob, blobsOut chan pbfio.DecodedBlob, errs chan error, stats *outputStats) error {
+	m := newMerger(cfg, func(blob pbfio.DecodedBlob) error {
+		return sendBlob(cfg, blob, blobsOut, errs, stats)
+	})
+	for blob := range blobsIn {
+		if err := m.processBlob(blob); err != nil {
+			return err
+		}
+	}
+	stats.order = m.order
+	return m.flush()
+}
+
+// mergedRun is the result of merging a run of blobs.
+type mergedRun struct {
+	blobs []pbfio.DecodedBlob
+	order sortChecker
+}
+
+// mergeConcurrently partitions the blobs from blobsIn into runs, which
+// are merged concurrently by cfg.jobs mergers. Because blobs are never
+// merged across runs, the output will contain slightly more blobs than
+// with mergeSequentially.
+func mergeConcurrently(cfg config, blobsIn chan pbfio.DecodedBlob, blobsOut chan pbfio.DecodedBlob, errs chan error, stats *outputStats) error {
+	runs := lineworker.NewWorkerPool(cfg.jobs, func(run []pbfio.DecodedBlob) (mergedRun, error) {
+		var merged mergedRun
+		m := newMerger(cfg, func(blob pbfio.DecodedBlob) error {
+			merged.blobs = append(merged.blobs, blob)
+			return nil
+		})
+		for _, blob := range run {
+			if err := m.processBlob(blob); err != nil {
+				return merged, err
+			}
+		}
+		merged.order = m.order
+		return merged, m.flush()
+	})
+	go feedRuns(cfg, blobsIn, runs)
 	for {
-		stop := false
-		select {
-		case blob, ok := <-blobsIn:
-			if ok {
-				if outBlob, err = processBlob(blob, outBlob, blobsOut, cfg); err != nil {
-					fmt.Fprintf(os.Stderr, "Error: Could not process blob: %v\n", err)
-					os.Exit(1)
-				}
-			} else {
-				stop = true
+		merged, err := runs.Next()
+		if err == lineworker.EOS {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		stats.order.append(merged.order)
+		if cfg.requireSorted && stats.order.unsorted && len(merged.blobs) > 0 {
+			return fmt.Errorf("%s: entities are not sorted by type and ID", merged.blobs[0].Position())
+		}
+		for _, blob := range merged.blobs {
+			if err = sendBlob(cfg, blob, blobsOut, errs, stats); err != nil {
+				return err
 			}
-		case err, ok := <-errs:
-			if ok {
-				fmt.Fprintf(os.Stderr, "Error: Could not write blob: %v\n", err)
-				os.Exit(1)
+		}
+	}
+}
+
+// feedRuns groups consecutive blobs from blobsIn into runs, whose raw
+// size is a multiple of the blob size limit, and passes them to runs.
+func feedRuns(cfg config, blobsIn chan pbfio.DecodedBlob, runs *lineworker.WorkerPool[[]pbfio.DecodedBlob, mergedRun]) {
+	defer runs.Stop()
+	var run []pbfio.DecodedBlob
+	var runSize int
+	var runKinds entityKinds
+	for blob := range blobsIn {
+		if blob.Err == nil && blob.PrimitiveBlock != nil {
+			// End the run at type transitions, if types are not mixed
+			// anyway, to avoid needlessly small blobs.
+			kinds := blockKinds(blob.PrimitiveBlock)
+			if len(run) > 0 && !cfg.mayJoin(runKinds, kinds) {
+				if !runs.Process(run) {
+					return
+				}
+				run, runSize = nil, 0
 			}
+			runKinds = kinds
 		}
-		if stop {
-			break
+		run = append(run, blob)
+		runSize += blob.RawSize
+		if blob.Err != nil || runSize >= runSizeFactor*cfg.maxBlobSize {
+			if !runs.Process(run) || blob.Err != nil {
+				return
+			}
+			run, runSize = nil, 0
 		}
 	}
+	if len(run) > 0 {
+		runs.Process(run)
+	}
+}
+
+// sendBlob passes blob on to the writer, unless the writer has failed.
+func sendBlob(cfg config, blob pbfio.DecodedBlob, blobsOut chan pbfio.DecodedBlob, errs chan error, stats *outputStats) error {
 	if cfg.verbose {
 		log.Printf("Info: Writing blob with raw size %2.3f MiB",
-			float64(outBlob.PrimitiveBlock.SizeVT())/1024/1024)
+			float64(blob.RawSize)/1024/1024)
 	}
-	blobsOut <- *outBlob
-	close(blobsOut)
-	if err, ok := <-errs; ok {
-		fmt.Fprintf(os.Stderr, "Could not write blob: %v\n", err)
-		os.Exit(1)
+	stats.blobs++
+	stats.rawSize += int64(blob.RawSize)
+	select {
+	case blobsOut <- blob:
+		return nil
+	case err := <-errs:
+		return fmt.Errorf("could not write blob: %v", err)
 	}
-	success = true
 }
 
 func validateOSMHeader(osmHeader pbfio.DecodedBlob) error {
@@ -161,55 +508,106 @@ func validateOSMHeader(osmHeader pbfio.DecodedBlob) error {
 	for _, reqFeature := range osmHeader.HeaderBlock.RequiredFeatures {
 		if reqFeature != "OsmSchema-V0.6" &&
 			reqFeature != "DenseNodes" &&
-			reqFeature != "HistoricalInformation" {
+			reqFeature != "HistoricalInformation" &&
+			reqFeature != "LocationsOnWays" {
 			return fmt.Errorf("unsupported feature '%s' is required", reqFeature)
 		}
 	}
 	return nil
 }
 
-func processBlob(blob pbfio.DecodedBlob, outBlob *pbfio.DecodedBlob, blobsOut chan pbfio.DecodedBlob, cfg config) (*pbfio.DecodedBlob, error) {
-	if *blob.BlobHeader.Type != "OSMData" {
-		return nil, fmt.Errorf("unexpected blob type '%s'.\n", *blob.BlobHeader.Type)
-	} else if blob.Err != nil {
-		return nil, fmt.Errorf("could not read blob: %v\n", blob.Err)
-	} else if outBlob == nil {
-		newStrings = nil
-		outBlob = &blob
-		outBlob.PrimitiveBlock.ClearGroupSizeCache()
-		if outBlob.PrimitiveBlock.MySize() >= cfg.maxBlobSize {
-			fmt.Fprintln(os.Stderr,
-				"Warning: A blob from the input file is already too large. Still using it.")
+// processBlob merges blob into the current output blob. If the result
+// would become too large, the current output blob is emitted instead
+// and blob becomes the new output blob. If cfg.window is set, blobs are
+// collected first, to find better split points.
+func (m *merger) processBlob(blob pbfio.DecodedBlob) error {
+	if blob.Err != nil {
+		return fmt.Errorf("could not read blob: %v", blob.Err)
+	} else if *blob.BlobHeader.Type != "OSMData" {
+		return fmt.Errorf("%s: unexpected blob type '%s'",
+			blob.Position(), *blob.BlobHeader.Type)
+	} else if err := checkWayLocations(blob.PrimitiveBlock, m.cfg.locationsOnWays); err != nil {
+		return fmt.Errorf("%s: %v", blob.Position(), err)
+	} else if !m.order.check(blob.PrimitiveBlock) && m.cfg.requireSorted {
+		return fmt.Errorf("%s: entities are not sorted by type and ID", blob.Position())
+	} else if m.cfg.window > 0 {
+		return m.addToWindow(blob)
+	}
+	return m.add(blob)
+}
+
+func (m *merger) add(blob pbfio.DecodedBlob) error {
+	if m.outBlob == nil {
+		m.startOutBlob(blob)
+		return nil
+	} else if !m.cfg.mayJoin(m.outKinds, blockKinds(blob.PrimitiveBlock)) {
+		if err := m.emitOutBlob(); err != nil {
+			return err
 		}
-	} else {
-		// Avoid cloning outBlock for performance:
-		outBlock := outBlob.PrimitiveBlock
-		origStringtableLen := len(outBlock.Stringtable.S)
-		origGroupLen := len(outBlock.Primitivegroup)
-
-		testBlock := blob.PrimitiveBlock.CloneVT()
-		ok := merge(outBlock, testBlock)
-		if !ok || outBlock.MySize() >= cfg.maxBlobSize {
-			// Restore outBlob to state before merge:
-			outBlock.Stringtable.S = outBlock.Stringtable.S[:origStringtableLen]
-			outBlock.Primitivegroup = outBlock.Primitivegroup[:origGroupLen]
-			testBlock.ReturnToVTPool()
-
-			if cfg.verbose {
-				log.Printf("Info: Writing blob with raw size %2.3f MiB",
-					float64(outBlob.PrimitiveBlock.MySize())/1024/1024)
-			}
-			blobsOut <- *outBlob
-			outBlob = &blob
-			newStrings = nil
-			outBlob.PrimitiveBlock.ClearGroupSizeCache()
-			if outBlob.PrimitiveBlock.MySize() >= cfg.maxBlobSize {
-				fmt.Fprintln(os.Stderr,
-					"Warning: A blob from the input file is already too large. Still using it.")
-			}
-		} else {
-			blob.PrimitiveBlock.ReturnToVTPool()
+		m.startOutBlob(blob)
+		return nil
+	}
+
+	// Avoid cloning outBlock for performance:
+	outBlock := m.outBlob.PrimitiveBlock
+	origStringtableLen := len(outBlock.Stringtable.S)
+	origGroupLen := len(outBlock.Primitivegroup)
+
+	testBlock := blob.PrimitiveBlock.CloneVT()
+	ok := m.merge(outBlock, testBlock)
+	if !ok || outBlock.MySize(&m.sizeCache) >= m.cfg.maxBlobSize {
+		// Restore outBlob to state before merge:
+		outBlock.Stringtable.S = outBlock.Stringtable.S[:origStringtableLen]
+		outBlock.Primitivegroup = outBlock.Primitivegroup[:origGroupLen]
+		testBlock.ReturnToVTPool()
+		if err := m.emitOutBlob(); err != nil {
+			return err
 		}
+		m.startOutBlob(blob)
+	} else {
+		// outBlob has been modified, so it cannot be passed through.
+		m.outBlob.RawBlob = nil
+		blob.PrimitiveBlock.ReturnToVTPool()
+	}
+	return nil
+}
+
+func (m *merger) startOutBlob(blob pbfio.DecodedBlob) {
+	m.outBlob = &blob
+	m.outKinds = blockKinds(blob.PrimitiveBlock)
+	m.newStrings = nil
+	m.sizeCache.Clear()
+	if m.outBlob.PrimitiveBlock.MySize(&m.sizeCache) >= m.cfg.maxBlobSize {
+		fmt.Fprintf(os.Stderr,
+			"Warning: %s from the input file is already too large. Still using it.\n",
+			blob.Position())
+	}
+}
+
+// flush emits all remaining blobs. It must be called after the last
+// call to processBlob.
+func (m *merger) flush() error {
+	if err := m.packWindow(true); err != nil {
+		return err
+	}
+	return m.emitOutBlob()
+}
+
+// emitOutBlob emits the current output blob, if there is one. Unused
+// strings are removed from it, unless it is passed through unchanged.
+func (m *merger) emitOutBlob() error {
+	if m.outBlob == nil {
+		return nil
+	}
+	block := m.outBlob.PrimitiveBlock
+	if m.outBlob.RawBlob == nil && pruneStrings(block) {
+		// The cached group sizes are outdated, because string indexes
+		// have changed.
+		m.outBlob.RawSize = block.SizeVT()
+	} else {
+		m.outBlob.RawSize = block.MySize(&m.sizeCache)
 	}
-	return outBlob, nil
+	err := m.emit(*m.outBlob)
+	m.outBlob = nil
+	return err
 }
@@ -1,46 +1,177 @@
 package main
 
 import (
+	"fmt"
+
+	"github.com/codesoap/pbf-reblob/pbfio"
 	"github.com/codesoap/pbf-reblob/pbfproto"
 )
 
-var newStrings map[string]int
-
-func merge(a, b *pbfproto.PrimitiveBlock) bool {
-	if a.DateGranularity != nil && b.DateGranularity == nil ||
-		a.DateGranularity == nil && b.DateGranularity != nil ||
-		a.DateGranularity != nil && *a.DateGranularity != *b.DateGranularity ||
-		a.LatOffset != nil && b.LatOffset == nil ||
-		a.LatOffset == nil && b.LatOffset != nil ||
-		a.LatOffset != nil && *a.LatOffset != *b.LatOffset ||
-		a.LonOffset != nil && b.LonOffset == nil ||
-		a.LonOffset == nil && b.LonOffset != nil ||
-		a.LonOffset != nil && *a.LonOffset != *b.LonOffset ||
-		a.Granularity != nil && b.Granularity == nil ||
-		a.Granularity == nil && b.Granularity != nil ||
-		a.Granularity != nil && *a.Granularity != *b.Granularity {
-		// TODO: Transform instead of aborting.
+// entityKinds is a set of the entity types found in a block.
+type entityKinds uint8
+
+const (
+	kindNodes entityKinds = 1 << iota
+	kindWays
+	kindRelations
+	kindChangesets
+)
+
+func blockKinds(block *pbfproto.PrimitiveBlock) entityKinds {
+	var kinds entityKinds
+	for _, group := range block.Primitivegroup {
+		if len(group.Nodes) > 0 || group.Dense != nil {
+			kinds |= kindNodes
+		}
+		if len(group.Ways) > 0 {
+			kinds |= kindWays
+		}
+		if len(group.Relations) > 0 {
+			kinds |= kindRelations
+		}
+		if len(group.Changesets) > 0 {
+			kinds |= kindChangesets
+		}
+	}
+	return kinds
+}
+
+// mayJoin reports whether blocks of kinds a and b may be merged. Unless
+// cfg.sameKind is set, this is always the case. Otherwise both must
+// contain only the same single entity type.
+func (cfg config) mayJoin(a, b entityKinds) bool {
+	return !cfg.sameKind || a == b && a&(a-1) == 0
+}
+
+// merger merges consecutive blobs into as few blobs as possible. All
+// state needed for merging is kept here, so that multiple mergers can
+// work concurrently.
+type merger struct {
+	cfg  config
+	emit func(blob pbfio.DecodedBlob) error
+
+	outBlob    *pbfio.DecodedBlob
+	outKinds   entityKinds
+	newStrings map[string]int
+	sizeCache  pbfproto.GroupSizeCache
+
+	// window holds blobs, that have not yet been packed, if
+	// cfg.window is set. windowSize is the sum of their sizes.
+	window     []windowBlob
+	windowSize int
+
+	// order checks the order of all blobs passed to processBlob.
+	order sortChecker
+}
+
+// newMerger creates a merger, which passes finished blobs to emit.
+func newMerger(cfg config, emit func(blob pbfio.DecodedBlob) error) *merger {
+	return &merger{cfg: cfg, emit: emit}
+}
+
+func (m *merger) merge(a, b *pbfproto.PrimitiveBlock) bool {
+	if !convertible(a, b) {
 		return false
 	}
-	if newStrings == nil {
-		newStrings = make(map[string]int, len(a.Stringtable.S))
+	convertUnits(a, b)
+	if m.newStrings == nil {
+		m.newStrings = make(map[string]int, len(a.Stringtable.S))
 		for i, s := range a.Stringtable.S {
-			newStrings[string(s)] = i
+			m.newStrings[string(s)] = i
 		}
 	}
 	i := len(a.Stringtable.S)
 	for _, s := range b.Stringtable.S {
-		if _, ok := newStrings[string(s)]; !ok {
+		if _, ok := m.newStrings[string(s)]; !ok {
 			a.Stringtable.S = append(a.Stringtable.S, s)
-			newStrings[string(s)] = i
+			m.newStrings[string(s)] = i
 			i++
 		}
 	}
-	updateStringIndexes(b, newStrings)
+	updateStringIndexes(b, m.newStrings)
 	a.Primitivegroup = append(a.Primitivegroup, b.Primitivegroup...)
 	return true
 }
 
+// convertible reports whether all locations and timestamps of b can be
+// expressed exactly in the units of a.
+func convertible(a, b *pbfproto.PrimitiveBlock) bool {
+	granularity := int64(a.GetGranularity())
+	return int64(b.GetGranularity())%granularity == 0 &&
+		(b.GetLatOffset()-a.GetLatOffset())%granularity == 0 &&
+		(b.GetLonOffset()-a.GetLonOffset())%granularity == 0 &&
+		b.GetDateGranularity()%a.GetDateGranularity() == 0
+}
+
+// convertUnits changes the locations and timestamps of b to the units
+// of a. convertible(a, b) must be true.
+func convertUnits(a, b *pbfproto.PrimitiveBlock) {
+	granularity := int64(a.GetGranularity())
+	scale := int64(b.GetGranularity()) / granularity
+	latShift := (b.GetLatOffset() - a.GetLatOffset()) / granularity
+	lonShift := (b.GetLonOffset() - a.GetLonOffset()) / granularity
+	dateScale := int64(b.GetDateGranularity() / a.GetDateGranularity())
+	if scale == 1 && latShift == 0 && lonShift == 0 && dateScale == 1 {
+		return
+	}
+	// Delta coded columns only need their first value to be shifted.
+	convertColumn := func(column []int64, shift int64) {
+		for i := range column {
+			column[i] *= scale
+		}
+		if len(column) > 0 {
+			column[0] += shift
+		}
+	}
+	convertInfo := func(info *pbfproto.Info) {
+		if info != nil && info.Timestamp != nil {
+			timestamp := *info.Timestamp * dateScale
+			info.Timestamp = &timestamp
+		}
+	}
+	for _, group := range b.Primitivegroup {
+		for _, node := range group.Nodes {
+			lat := node.GetLat()*scale + latShift
+			lon := node.GetLon()*scale + lonShift
+			node.Lat, node.Lon = &lat, &lon
+			convertInfo(node.Info)
+		}
+		if dense := group.Dense; dense != nil {
+			convertColumn(dense.Lat, latShift)
+			convertColumn(dense.Lon, lonShift)
+			if dense.Denseinfo != nil {
+				for i := range dense.Denseinfo.Timestamp {
+					dense.Denseinfo.Timestamp[i] *= dateScale
+				}
+			}
+		}
+		for _, way := range group.Ways {
+			convertColumn(way.Lat, latShift)
+			convertColumn(way.Lon, lonShift)
+			convertInfo(way.Info)
+		}
+		for _, rel := range group.Relations {
+			convertInfo(rel.Info)
+		}
+	}
+}
+
+// checkWayLocations checks, that every way of block has either no
+// locations or one for each node. If required is set, locations must be
+// present.
+func checkWayLocations(block *pbfproto.PrimitiveBlock, required bool) error {
+	for _, group := range block.Primitivegroup {
+		for _, way := range group.Ways {
+			if len(way.Lat) != len(way.Lon) ||
+				len(way.Lat) != len(way.Refs) && (required || len(way.Lat) > 0) {
+				return fmt.Errorf("way %d has %d nodes but %d latitudes and %d longitudes",
+					way.GetId(), len(way.Refs), len(way.Lat), len(way.Lon))
+			}
+		}
+	}
+	return nil
+}
+
 func updateStringIndexes(block *pbfproto.PrimitiveBlock, indexes map[string]int) {
 	for _, group := range block.Primitivegroup {
 		if len(group.Nodes) > 0 {
@@ -80,14 +211,12 @@ func updateNodesStringIndexes(nodes []*pbfproto.Node, oldStringtable [][]byte, i
 func updateDenseNodesStringIndexes(nodes *pbfproto.DenseNodes, oldStringtable [][]byte, indexes map[string]int) {
 	if nodes.Denseinfo != nil {
 		newSIDs := make([]int32, len(nodes.Denseinfo.UserSid))
-		var sid int32
+		var sid, prevNewSID int32
 		for i, delta := range nodes.Denseinfo.UserSid {
 			sid += delta
-			if i == 0 {
-				newSIDs[i] = int32(indexes[string(oldStringtable[sid])])
-			} else {
-				newSIDs[i] = int32(indexes[string(oldStringtable[sid])]) - newSIDs[i-1]
-			}
+			newSID := int32(indexes[string(oldStringtable[sid])])
+			newSIDs[i] = newSID - prevNewSID
+			prevNewSID = newSID
 		}
 		nodes.Denseinfo.UserSid = newSIDs
 	}
@@ -136,5 +265,10 @@ func updateRelationsStringIndexes(rels []*pbfproto.Relation, oldStringtable [][]
 			newVals[i] = uint32(indexes[string(oldStringtable[sid])])
 		}
 		rel.Vals = newVals
+		newRoles := make([]int32, len(rel.RolesSid))
+		for i, sid := range rel.RolesSid {
+			newRoles[i] = int32(indexes[string(oldStringtable[sid])])
+		}
+		rel.RolesSid = newRoles
 	}
 }
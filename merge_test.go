@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/codesoap/pbf-reblob/pbfio"
+	"github.com/codesoap/pbf-reblob/pbfproto"
+)
+
+// testBlock creates a block with dense nodes, a way and a relation,
+// whose strings are specific to n.
+func testBlock(n int) *pbfproto.PrimitiveBlock {
+	user := []byte(fmt.Sprint("user", n%3))
+	block := &pbfproto.PrimitiveBlock{
+		Stringtable: &pbfproto.StringTable{S: [][]byte{
+			{}, []byte("highway"), []byte(fmt.Sprint("value", n)), user,
+			[]byte("outer"), []byte(fmt.Sprint("role", n)),
+		}},
+	}
+	id := int64(n * 10)
+	dense := &pbfproto.DenseNodes{
+		Id:        []int64{id, 1, 1},
+		Lat:       []int64{10, 1, 1},
+		Lon:       []int64{20, 1, 1},
+		KeysVals:  []int32{1, 2, 0, 0, 1, 2, 0},
+		Denseinfo: &pbfproto.DenseInfo{UserSid: []int32{3, 0, 0}},
+	}
+	userSid := uint32(3)
+	way := &pbfproto.Way{
+		Id:   &id,
+		Keys: []uint32{1},
+		Vals: []uint32{2},
+		Info: &pbfproto.Info{UserSid: &userSid},
+		Refs: []int64{id, 1},
+	}
+	rel := &pbfproto.Relation{
+		Id:       &id,
+		Keys:     []uint32{1},
+		Vals:     []uint32{2},
+		RolesSid: []int32{4, 5},
+		Memids:   []int64{id, 1},
+		Types:    []pbfproto.Relation_MemberType{0, 0},
+	}
+	block.Primitivegroup = []*pbfproto.PrimitiveGroup{
+		{Dense: dense},
+		{Ways: []*pbfproto.Way{way}},
+		{Relations: []*pbfproto.Relation{rel}},
+	}
+	return block
+}
+
+// entityStrings lists all entities of block with their resolved
+// strings.
+func entityStrings(block *pbfproto.PrimitiveBlock) []string {
+	st := block.Stringtable.S
+	var out []string
+	for _, group := range block.Primitivegroup {
+		if dense := group.Dense; dense != nil {
+			var id int64
+			var sid int32
+			kv := dense.KeysVals
+			for i := range dense.Id {
+				id += dense.Id[i]
+				sid += dense.Denseinfo.UserSid[i]
+				s := fmt.Sprintf("n%d user=%s", id, st[sid])
+				for ; kv[0] != 0; kv = kv[2:] {
+					s += fmt.Sprintf(" %s=%s", st[kv[0]], st[kv[1]])
+				}
+				kv = kv[1:]
+				out = append(out, s)
+			}
+		}
+		for _, way := range group.Ways {
+			s := fmt.Sprintf("w%d user=%s", way.GetId(), st[way.Info.GetUserSid()])
+			for i := range way.Keys {
+				s += fmt.Sprintf(" %s=%s", st[way.Keys[i]], st[way.Vals[i]])
+			}
+			out = append(out, s)
+		}
+		for _, rel := range group.Relations {
+			s := fmt.Sprintf("r%d", rel.GetId())
+			for i := range rel.Keys {
+				s += fmt.Sprintf(" %s=%s", st[rel.Keys[i]], st[rel.Vals[i]])
+			}
+			for _, role := range rel.RolesSid {
+				s += fmt.Sprintf(" role=%s", st[role])
+			}
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func testBlobs(count int) []pbfio.DecodedBlob {
+	typ := "OSMData"
+	blobs := make([]pbfio.DecodedBlob, count)
+	for i := range blobs {
+		blobs[i] = pbfio.DecodedBlob{
+			BlobHeader:     &pbfproto.BlobHeader{Type: &typ},
+			Index:          i,
+			PrimitiveBlock: testBlock(i),
+		}
+	}
+	return blobs
+}
+
+// mergeAll merges blobs and returns the strings of the merged entities
+// and the sizes of the output blobs.
+func mergeAll(t *testing.T, blobs []pbfio.DecodedBlob, cfg config) ([]string, []int) {
+	var merged []pbfio.DecodedBlob
+	m := newMerger(cfg, func(blob pbfio.DecodedBlob) error {
+		merged = append(merged, blob)
+		return nil
+	})
+	for _, blob := range blobs {
+		if err := m.processBlob(blob); err != nil {
+			t.Error(err)
+			return nil, nil
+		}
+	}
+	if err := m.flush(); err != nil {
+		t.Error(err)
+		return nil, nil
+	}
+	var out []string
+	var sizes []int
+	for _, blob := range merged {
+		if size := blob.PrimitiveBlock.SizeVT(); blob.RawSize != size {
+			t.Errorf("RawSize is %d, but SizeVT is %d", blob.RawSize, size)
+		} else if size >= cfg.maxBlobSize {
+			t.Errorf("blob of size %d exceeds limit", size)
+		}
+		sizes = append(sizes, blob.RawSize)
+		out = append(out, entityStrings(blob.PrimitiveBlock)...)
+	}
+	return out, sizes
+}
+
+func TestMerge(t *testing.T) {
+	var want []string
+	for _, blob := range testBlobs(20) {
+		want = append(want, entityStrings(blob.PrimitiveBlock)...)
+	}
+	got, sizes := mergeAll(t, testBlobs(20), config{maxBlobSize: 1024})
+	if !slices.Equal(got, want) {
+		t.Errorf("merged entities differ:\ngot  %q\nwant %q", got, want)
+	}
+	if len(sizes) < 2 || len(sizes) >= 20 {
+		t.Errorf("unexpected amount of merged blobs: %d", len(sizes))
+	}
+}
+
+func TestWindowedMerge(t *testing.T) {
+	want, greedySizes := mergeAll(t, testBlobs(45), config{maxBlobSize: 2048})
+	for _, window := range []int{1, 3, 20} {
+		cfg := config{maxBlobSize: 2048, window: window}
+		got, sizes := mergeAll(t, testBlobs(45), cfg)
+		if !slices.Equal(got, want) {
+			t.Errorf("window %d: merged entities differ", window)
+		}
+		if len(sizes) != len(greedySizes) {
+			t.Errorf("window %d: got %d blobs, want %d", window, len(sizes), len(greedySizes))
+		} else if slices.Min(sizes) < slices.Min(greedySizes) {
+			t.Errorf("window %d: smallest blob is smaller than without window", window)
+		}
+	}
+}
+
+func TestConcurrentMergers(t *testing.T) {
+	want, wantSizes := mergeAll(t, testBlobs(50), config{maxBlobSize: 2048})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, sizes := mergeAll(t, testBlobs(50), config{maxBlobSize: 2048})
+			if !slices.Equal(got, want) || !slices.Equal(sizes, wantSizes) {
+				t.Errorf("concurrent merge produced different result")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSameKindMerge(t *testing.T) {
+	for _, window := range []int{0, 2} {
+		// Split the test blocks into one block per entity type,
+		// sorted by type.
+		var blobs []pbfio.DecodedBlob
+		for i := 0; i < 3; i++ {
+			for _, blob := range testBlobs(30) {
+				block := blob.PrimitiveBlock
+				block.Primitivegroup = block.Primitivegroup[i : i+1]
+				blobs = append(blobs, blob)
+			}
+		}
+		var merged []pbfio.DecodedBlob
+		m := newMerger(config{maxBlobSize: 4096, sameKind: true, window: window}, func(blob pbfio.DecodedBlob) error {
+			merged = append(merged, blob)
+			return nil
+		})
+		for _, blob := range blobs {
+			if err := m.processBlob(blob); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := m.flush(); err != nil {
+			t.Fatal(err)
+		}
+		for _, blob := range merged {
+			if kinds := blockKinds(blob.PrimitiveBlock); kinds&(kinds-1) != 0 {
+				t.Errorf("window %d: blob contains entity types %b", window, kinds)
+			}
+		}
+		if len(merged) < 3 || len(merged) >= len(blobs) {
+			t.Errorf("window %d: unexpected amount of merged blobs: %d", window, len(merged))
+		}
+	}
+}
+
+func TestMergeUnits(t *testing.T) {
+	blobs := testBlobs(12)
+	var want []pbfio.Entity
+	for i, blob := range blobs {
+		block := blob.PrimitiveBlock
+		way := block.Primitivegroup[1].Ways[0]
+		way.Lat, way.Lon = []int64{int64(i), 3}, []int64{-5, int64(i)}
+		switch i % 3 {
+		case 1:
+			block.Granularity = ptr[int32](1000)
+			block.LatOffset = ptr[int64](-2000)
+			block.DateGranularity = ptr[int32](2000)
+			block.Primitivegroup[0].Dense.Denseinfo.Timestamp = []int64{10, 1, 1}
+		case 2:
+			// Not convertible to the default granularity of 100.
+			block.LonOffset = ptr[int64](30)
+		}
+		entities, err := pbfio.Entities(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, entities...)
+	}
+	var got []pbfio.Entity
+	m := newMerger(config{maxBlobSize: 1 << 20}, func(blob pbfio.DecodedBlob) error {
+		entities, err := pbfio.Entities(blob.PrimitiveBlock)
+		got = append(got, entities...)
+		return err
+	})
+	for _, blob := range blobs {
+		if err := m.processBlob(blob); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("entities differ after merging blocks with different units")
+	}
+}
+
+func TestMergePrunesStrings(t *testing.T) {
+	var want []string
+	blobs := testBlobs(10)
+	for i, blob := range blobs {
+		want = append(want, entityStrings(blob.PrimitiveBlock)...)
+		st := blob.PrimitiveBlock.Stringtable
+		st.S = append(st.S, []byte(fmt.Sprint("unused", i)))
+	}
+	var got []string
+	m := newMerger(config{maxBlobSize: 1024}, func(blob pbfio.DecodedBlob) error {
+		for _, s := range blob.PrimitiveBlock.Stringtable.S {
+			if bytes.HasPrefix(s, []byte("unused")) {
+				t.Errorf("unused string '%s' was not pruned", s)
+			}
+		}
+		if size := blob.PrimitiveBlock.SizeVT(); blob.RawSize != size {
+			t.Errorf("RawSize is %d, but SizeVT is %d", blob.RawSize, size)
+		}
+		got = append(got, entityStrings(blob.PrimitiveBlock)...)
+		return nil
+	})
+	for _, blob := range blobs {
+		if err := m.processBlob(blob); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("merged entities differ:\ngot  %q\nwant %q", got, want)
+	}
+}
+
+func TestMergeConcurrently(t *testing.T) {
+	// Blocks with one entity type each, sorted by type, so that runs
+	// also end at type transitions with -t.
+	typedBlobs := func() []pbfio.DecodedBlob {
+		var blobs []pbfio.DecodedBlob
+		for i := 0; i < 3; i++ {
+			for _, blob := range testBlobs(100) {
+				block := blob.PrimitiveBlock
+				block.Primitivegroup = block.Primitivegroup[i : i+1]
+				blob.RawSize = block.SizeVT()
+				blobs = append(blobs, blob)
+			}
+		}
+		return blobs
+	}
+	// Like with mergeSequentially, the entities must keep their order.
+	var want []string
+	var rawSize int
+	for _, blob := range typedBlobs() {
+		want = append(want, entityStrings(blob.PrimitiveBlock)...)
+		rawSize += blob.RawSize
+	}
+	cfg := config{maxBlobSize: 512, sameKind: true, jobs: 4}
+	if runs := rawSize / (runSizeFactor * cfg.maxBlobSize); runs < 8 {
+		t.Fatalf("test blobs only fill %d runs", runs)
+	}
+	blobsIn := make(chan pbfio.DecodedBlob)
+	go func() {
+		for _, blob := range typedBlobs() {
+			blobsIn <- blob
+		}
+		close(blobsIn)
+	}()
+	blobsOut := make(chan pbfio.DecodedBlob)
+	done := make(chan error, 1)
+	go func() {
+		done <- mergeConcurrently(cfg, blobsIn, blobsOut, make(chan error), &outputStats{})
+		close(blobsOut)
+	}()
+	var got []string
+	for blob := range blobsOut {
+		if kinds := blockKinds(blob.PrimitiveBlock); kinds&(kinds-1) != 0 {
+			t.Errorf("blob contains entity types %b", kinds)
+		} else if size := blob.PrimitiveBlock.SizeVT(); size >= cfg.maxBlobSize {
+			t.Errorf("blob of size %d exceeds limit", size)
+		}
+		got = append(got, entityStrings(blob.PrimitiveBlock)...)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("concurrently merged entities differ:\ngot  %q\nwant %q", got, want)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoMmap = errors.New("the dense location store is not supported on this platform")
+
+func mmap(file *os.File, size int64) ([]byte, error) {
+	return nil, errNoMmap
+}
+
+func munmap(data []byte) error {
+	return errNoMmap
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"slices"
+
+	"github.com/codesoap/pbf-reblob/pbfproto"
+)
+
+// sortFeature is the optional feature of files, whose entities are
+// sorted by type, then ID.
+const sortFeature = "Sort.Type_then_ID"
+
+// sortChecker checks whether a sequence of entities is sorted by type,
+// then ID. Nodes come first, then ways, then relations. Equal IDs are
+// allowed, because history files contain multiple versions of an entity.
+type sortChecker struct {
+	count     int
+	firstKind entityKinds
+	firstID   int64
+	lastKind  entityKinds
+	lastID    int64
+	unsorted  bool
+}
+
+// check adds the entities of block to the sequence and reports whether
+// it is still sorted.
+func (c *sortChecker) check(block *pbfproto.PrimitiveBlock) bool {
+	for _, group := range block.Primitivegroup {
+		if c.unsorted {
+			break
+		}
+		for _, node := range group.Nodes {
+			c.next(kindNodes, node.GetId())
+		}
+		if group.Dense != nil {
+			var id int64
+			for _, delta := range group.Dense.Id {
+				id += delta
+				c.next(kindNodes, id)
+			}
+		}
+		for _, way := range group.Ways {
+			c.next(kindWays, way.GetId())
+		}
+		for _, rel := range group.Relations {
+			c.next(kindRelations, rel.GetId())
+		}
+	}
+	return !c.unsorted
+}
+
+func (c *sortChecker) next(kind entityKinds, id int64) {
+	if c.count == 0 {
+		c.firstKind, c.firstID = kind, id
+	} else if kind < c.lastKind || kind == c.lastKind && id < c.lastID {
+		c.unsorted = true
+	}
+	c.lastKind, c.lastID = kind, id
+	c.count++
+}
+
+// append adds the sequence checked by o to the end of the sequence of c.
+func (c *sortChecker) append(o sortChecker) {
+	if o.count == 0 {
+		return
+	}
+	c.next(o.firstKind, o.firstID)
+	c.count += o.count - 1
+	c.lastKind, c.lastID = o.lastKind, o.lastID
+	c.unsorted = c.unsorted || o.unsorted
+}
+
+// dropSortFeature removes sortFeature from the OSMHeader of outFile.
+// Whether the input is sorted is only known after it has been written,
+// so outFile is copied once more. This is only needed for inputs, whose
+// header wrongly claims to be sorted; checking all inputs beforehand
+// would need an extra pass over every input instead.
+func dropSortFeature(outFile string) error {
+	return editHeader(outFile, headerEdits{func(h *pbfproto.HeaderBlock) {
+		h.OptionalFeatures = slices.DeleteFunc(h.OptionalFeatures, func(feature string) bool {
+			return feature == sortFeature
+		})
+	}})
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestSortCheckerAppend(t *testing.T) {
+	type entity struct {
+		kind entityKinds
+		id   int64
+	}
+	tests := []struct {
+		entities []entity
+		sorted   bool
+	}{
+		{[]entity{{kindNodes, 1}, {kindNodes, 2}, {kindWays, 1}, {kindRelations, 1}}, true},
+		{[]entity{{kindNodes, 1}, {kindNodes, 1}, {kindWays, 5}, {kindWays, 7}}, true},
+		{[]entity{{kindNodes, 2}, {kindNodes, 1}, {kindWays, 1}, {kindWays, 2}}, false},
+		{[]entity{{kindNodes, 1}, {kindWays, 2}, {kindNodes, 3}, {kindWays, 4}}, false},
+		{[]entity{{kindWays, 1}, {kindWays, 3}, {kindWays, 2}, {kindRelations, 1}}, false},
+	}
+	for i, test := range tests {
+		// Every split into two parts must give the same result as
+		// checking the whole sequence.
+		for split := 0; split <= len(test.entities); split++ {
+			var a, b sortChecker
+			for _, e := range test.entities[:split] {
+				a.next(e.kind, e.id)
+			}
+			for _, e := range test.entities[split:] {
+				b.next(e.kind, e.id)
+			}
+			a.append(b)
+			if a.unsorted == test.sorted || a.count != len(test.entities) {
+				t.Errorf("test %d, split %d: got unsorted=%t, count=%d", i, split, a.unsorted, a.count)
+			}
+		}
+	}
+}
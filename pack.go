@@ -0,0 +1,137 @@
+package main
+
+import (
+	"slices"
+
+	"github.com/codesoap/pbf-reblob/pbfio"
+	"github.com/planetscale/vtprotobuf/protohelpers"
+)
+
+// windowBlob is a blob in the look-ahead window of a merger, together
+// with its entity types and the marshalled size of its groups and
+// strings.
+type windowBlob struct {
+	blob                    pbfio.DecodedBlob
+	kinds                   entityKinds
+	groupsSize, stringsSize int
+}
+
+func (m *merger) addToWindow(blob pbfio.DecodedBlob) error {
+	wb := windowBlob{blob: blob, kinds: blockKinds(blob.PrimitiveBlock)}
+	if len(m.window) > 0 && !m.cfg.mayJoin(m.window[len(m.window)-1].kinds, wb.kinds) {
+		// Blobs before a type transition can be packed right away.
+		if err := m.packWindow(true); err != nil {
+			return err
+		}
+	}
+	for _, group := range blob.PrimitiveBlock.Primitivegroup {
+		l := group.SizeVT()
+		wb.groupsSize += 1 + l + protohelpers.SizeOfVarint(uint64(l))
+	}
+	for _, s := range blob.PrimitiveBlock.Stringtable.S {
+		wb.stringsSize += stringSize(s)
+	}
+	m.window = append(m.window, wb)
+	m.windowSize += wb.groupsSize + wb.stringsSize
+	if m.windowSize < (m.cfg.window+1)*m.cfg.maxBlobSize {
+		return nil
+	}
+	return m.packWindow(false)
+}
+
+// packWindow merges the blobs of the window into output blobs. Unless
+// final is set, the blobs of the last output blob stay in the window,
+// because later blobs might still fit into it.
+func (m *merger) packWindow(final bool) error {
+	if len(m.window) == 0 {
+		return nil
+	}
+	ends := m.splitPoints(final)
+	if !final {
+		ends = ends[:len(ends)-1]
+	}
+	start := 0
+	for _, end := range ends {
+		for _, wb := range m.window[start:end] {
+			if err := m.add(wb.blob); err != nil {
+				return err
+			}
+		}
+		// If the size was underestimated, add has already emitted a
+		// blob and this one will be smaller than planned.
+		if err := m.emitOutBlob(); err != nil {
+			return err
+		}
+		start = end
+	}
+	m.window = slices.Clone(m.window[start:])
+	m.windowSize = 0
+	for _, wb := range m.window {
+		m.windowSize += wb.groupsSize + wb.stringsSize
+	}
+	return nil
+}
+
+// splitPoints returns the indexes of the window at which output blobs
+// should end. The split points are chosen so that the amount of output
+// blobs is minimal and, among those solutions, the output blobs are
+// filled as evenly as possible. Unless final is set, the last output
+// blob is ignored when judging the fill, because more blobs may be
+// added to it later.
+func (m *merger) splitPoints(final bool) []int {
+	type solution struct {
+		blobs   int
+		penalty float64 // The sum of the squared unused capacities.
+		prev    int
+	}
+	n := len(m.window)
+	best := make([]solution, n+1)
+	for i := 1; i <= n; i++ {
+		best[i].blobs = -1
+	}
+	for i := 0; i < n; i++ {
+		seen := make(map[string]bool)
+		var stringsSize, groupsSize int
+		for j := i; j < n; j++ {
+			for _, s := range m.window[j].blob.PrimitiveBlock.Stringtable.S {
+				if !seen[string(s)] {
+					seen[string(s)] = true
+					stringsSize += stringSize(s)
+				}
+			}
+			groupsSize += m.window[j].groupsSize
+			size := estimateSize(stringsSize, groupsSize)
+			if j > i && (size >= m.cfg.maxBlobSize || !m.cfg.mayJoin(m.window[i].kinds, m.window[j].kinds)) {
+				break
+			}
+			candidate := solution{blobs: best[i].blobs + 1, penalty: best[i].penalty, prev: i}
+			if final || j+1 < n {
+				unused := max(0, float64(m.cfg.maxBlobSize-size)/float64(m.cfg.maxBlobSize))
+				candidate.penalty += unused * unused
+			}
+			if best[j+1].blobs < 0 ||
+				candidate.blobs < best[j+1].blobs ||
+				candidate.blobs == best[j+1].blobs && candidate.penalty < best[j+1].penalty {
+				best[j+1] = candidate
+			}
+		}
+	}
+	var ends []int
+	for i := n; i > 0; i = best[i].prev {
+		ends = append(ends, i)
+	}
+	slices.Reverse(ends)
+	return ends
+}
+
+// stringSize returns the marshalled size of s within a StringTable.
+func stringSize(s []byte) int {
+	return 1 + protohelpers.SizeOfVarint(uint64(len(s))) + len(s)
+}
+
+// estimateSize estimates the size of a merged PrimitiveBlock. String IDs
+// may need more bytes after merging, so a small margin is added.
+func estimateSize(stringsSize, groupsSize int) int {
+	size := 1 + protohelpers.SizeOfVarint(uint64(stringsSize)) + stringsSize + groupsSize + 32
+	return size + size/100
+}
@@ -0,0 +1,74 @@
+package pbfio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/codesoap/pbf-reblob/pbfproto"
+)
+
+// BlobReader reads individual blobs from arbitrary positions of a PBF
+// file. It is safe for concurrent use.
+type BlobReader struct {
+	r            io.ReaderAt
+	decompressor *decompressor
+}
+
+// NewBlobReader creates a BlobReader, which reads from r. Close should
+// be called when the BlobReader is no longer needed.
+func NewBlobReader(r io.ReaderAt) *BlobReader {
+	return &BlobReader{r: r, decompressor: newDecompressor()}
+}
+
+// ReadBlob reads and decodes the blob, whose BlobHeader's length prefix
+// is located at offset. Offsets can be taken from an index or from
+// DecodedBlob.Offset. The Index of the returned blob is always -1,
+// because it is not known.
+func (br *BlobReader) ReadBlob(offset int64) (DecodedBlob, error) {
+	buf := make([]byte, 4)
+	if _, err := br.r.ReadAt(buf, offset); err != nil {
+		return DecodedBlob{}, fmt.Errorf("could not read blob header size at offset %d: %v", offset, err)
+	}
+	headerSize := binary.BigEndian.Uint32(buf)
+	if headerSize >= maxBlobHeaderSize {
+		return DecodedBlob{}, fmt.Errorf("blobHeader size %d at offset %d >= 64KiB", headerSize, offset)
+	}
+	buf = make([]byte, headerSize)
+	if _, err := br.r.ReadAt(buf, offset+4); err != nil {
+		return DecodedBlob{}, fmt.Errorf("could not read BlobHeader at offset %d: %v", offset, err)
+	}
+	ub := &undecodedBlob{
+		decompressor: br.decompressor,
+		blobHeader:   &pbfproto.BlobHeader{},
+		index:        -1,
+		offset:       offset,
+		headerSize:   int(headerSize),
+	}
+	if err := ub.blobHeader.UnmarshalVT(buf); err != nil {
+		return DecodedBlob{}, fmt.Errorf("could not unmarshal BlobHeader at offset %d: %v", offset, err)
+	} else if ub.blobHeader.Type == nil {
+		return DecodedBlob{}, fmt.Errorf("fileblock at offset %d is missing type", offset)
+	} else if datasize := ub.blobHeader.GetDatasize(); datasize <= 0 || datasize > maxDatasize {
+		return DecodedBlob{}, fmt.Errorf("invalid datasize %d at offset %d", datasize, offset)
+	}
+	ub.blob = rawBlobPool.Get().([]byte)
+	if cap(ub.blob) < int(*ub.blobHeader.Datasize) {
+		ub.blob = make([]byte, *ub.blobHeader.Datasize)
+	}
+	ub.blob = ub.blob[:*ub.blobHeader.Datasize]
+	if _, err := br.r.ReadAt(ub.blob, offset+4+int64(headerSize)); err != nil {
+		rawBlobPool.Put(ub.blob)
+		return DecodedBlob{}, fmt.Errorf("could not read blob at offset %d: %v", offset, err)
+	}
+	blob, err := decodeBlob(ub)
+	if err != nil {
+		return blob, fmt.Errorf("%s: %v", blob.Position(), err)
+	}
+	return blob, nil
+}
+
+// Close releases the resources of br.
+func (br *BlobReader) Close() error {
+	return br.decompressor.close()
+}
@@ -0,0 +1,314 @@
+package pbfio
+
+import (
+	"github.com/codesoap/pbf-reblob/pbfproto"
+	"github.com/planetscale/vtprotobuf/protohelpers"
+)
+
+// Default granularities of PrimitiveBlocks.
+const (
+	defaultGranularity     = 100
+	defaultDateGranularity = 1000
+)
+
+// BlockBuilder assembles entities into PrimitiveBlocks. Consecutive
+// entities of the same type are stored in one PrimitiveGroup; nodes are
+// stored as DenseNodes.
+type BlockBuilder struct {
+	// Granularity, in nanodegrees, and DateGranularity, in
+	// milliseconds, are used for new blocks. Zero values select the
+	// defaults of 100 and 1000. Locations and timestamps are rounded to
+	// these granularities.
+	Granularity     int32
+	DateGranularity int32
+
+	block     *pbfproto.PrimitiveBlock
+	strings   map[string]int32
+	emptySid  int32 // The index of the empty string added by denseSid.
+	group     *pbfproto.PrimitiveGroup
+	groupType EntityType
+	count     int
+
+	// Whether the current group of dense nodes stores metadata and
+	// visibility.
+	denseInfo, denseVisible bool
+
+	// The previous values of the delta coded fields of the current
+	// group of dense nodes.
+	prevID, prevLat, prevLon, prevTimestamp, prevChangeset int64
+	prevUID, prevUserSid                                   int32
+
+	// measured is the size of block when it was last measured. pending
+	// is an upper bound for the growth of block since then.
+	measured, pending int
+}
+
+// Len returns the amount of entities in the current block.
+func (b *BlockBuilder) Len() int {
+	return b.count
+}
+
+// Fits reports whether e can be added to the current block without the
+// marshalled size of the block reaching maxSize. An empty block fits
+// every entity.
+func (b *BlockBuilder) Fits(e *Entity, maxSize int) bool {
+	if b.count == 0 {
+		return true
+	}
+	bound := b.sizeBound(e)
+	if b.measured+b.pending+bound < maxSize {
+		return true
+	}
+	b.measured, b.pending = b.block.SizeVT(), 0
+	return b.measured+bound < maxSize
+}
+
+// Add appends e to the current block.
+func (b *BlockBuilder) Add(e *Entity) {
+	if b.block == nil {
+		b.startBlock()
+	}
+	b.pending += b.sizeBound(e)
+	hasInfo := e.Info != nil
+	hasVisible := hasInfo && e.Info.Visible != nil
+	if b.group == nil || b.groupType != e.Type ||
+		e.Type == NodeType && (b.denseInfo != hasInfo || b.denseVisible != hasVisible) {
+		b.startGroup(e.Type, hasInfo, hasVisible)
+	}
+	switch e.Type {
+	case NodeType:
+		b.addNode(e)
+	case WayType:
+		b.addWay(e)
+	case RelationType:
+		b.addRelation(e)
+	}
+	b.count++
+}
+
+// Build returns the current block and starts a new one. If no entities
+// have been added, nil is returned.
+func (b *BlockBuilder) Build() *pbfproto.PrimitiveBlock {
+	block := b.block
+	b.block, b.group, b.strings = nil, nil, nil
+	b.count, b.measured, b.pending = 0, 0, 0
+	return block
+}
+
+func (b *BlockBuilder) granularity() int64 {
+	if b.Granularity == 0 {
+		return defaultGranularity
+	}
+	return int64(b.Granularity)
+}
+
+func (b *BlockBuilder) dateGranularity() int64 {
+	if b.DateGranularity == 0 {
+		return defaultDateGranularity
+	}
+	return int64(b.DateGranularity)
+}
+
+func (b *BlockBuilder) startBlock() {
+	// The first string is never used, because 0 separates the nodes in
+	// DenseNodes.KeysVals.
+	b.block = &pbfproto.PrimitiveBlock{
+		Stringtable: &pbfproto.StringTable{S: [][]byte{{}}},
+	}
+	if g := b.granularity(); g != defaultGranularity {
+		granularity := int32(g)
+		b.block.Granularity = &granularity
+	}
+	if g := b.dateGranularity(); g != defaultDateGranularity {
+		dateGranularity := int32(g)
+		b.block.DateGranularity = &dateGranularity
+	}
+	b.strings = map[string]int32{"": 0}
+	b.emptySid = 0
+}
+
+func (b *BlockBuilder) startGroup(typ EntityType, denseInfo, denseVisible bool) {
+	b.group = &pbfproto.PrimitiveGroup{}
+	b.groupType = typ
+	if typ == NodeType {
+		b.group.Dense = &pbfproto.DenseNodes{}
+		if denseInfo {
+			b.group.Dense.Denseinfo = &pbfproto.DenseInfo{}
+		}
+		b.denseInfo, b.denseVisible = denseInfo, denseVisible
+		b.prevID, b.prevLat, b.prevLon, b.prevTimestamp, b.prevChangeset = 0, 0, 0, 0, 0
+		b.prevUID, b.prevUserSid = 0, 0
+	}
+	b.block.Primitivegroup = append(b.block.Primitivegroup, b.group)
+}
+
+// sid returns the index of s in the string table, adding s if needed.
+// The empty string uses the unused first string.
+func (b *BlockBuilder) sid(s string) int32 {
+	if sid, ok := b.strings[s]; ok {
+		return sid
+	}
+	sid := int32(len(b.block.Stringtable.S))
+	b.block.Stringtable.S = append(b.block.Stringtable.S, []byte(s))
+	b.strings[s] = sid
+	return sid
+}
+
+// denseSid is like sid, but never returns 0, which separates the nodes
+// in DenseNodes.KeysVals. An empty string is added once, if needed.
+func (b *BlockBuilder) denseSid(s string) int32 {
+	if s != "" {
+		return b.sid(s)
+	} else if b.emptySid == 0 {
+		b.emptySid = int32(len(b.block.Stringtable.S))
+		b.block.Stringtable.S = append(b.block.Stringtable.S, []byte{})
+	}
+	return b.emptySid
+}
+
+// sizeBound returns an upper bound for the growth of the marshalled
+// block, if e is added.
+func (b *BlockBuilder) sizeBound(e *Entity) int {
+	const varint = 10
+	n := 64 // For a new group and growing length prefixes.
+	for _, tag := range e.Tags {
+		n += 2*varint + b.stringBound(tag.Key) + b.stringBound(tag.Value)
+	}
+	if e.Info != nil {
+		n += 6*(1+varint) + b.stringBound(e.Info.User)
+	}
+	switch e.Type {
+	case NodeType:
+		n += 3 * varint
+	case WayType:
+		n += 2*varint + varint*len(e.Refs) + 2*varint*len(e.RefLats)
+	case RelationType:
+		n += 2 * varint
+		for _, member := range e.Members {
+			n += 2*varint + 1 + b.stringBound(member.Role)
+		}
+	}
+	return n
+}
+
+func (b *BlockBuilder) stringBound(s string) int {
+	if _, ok := b.strings[s]; ok {
+		return 0
+	}
+	return 1 + protohelpers.SizeOfVarint(uint64(len(s))) + len(s)
+}
+
+// coordinate converts a location in nanodegrees to the units of the
+// block, rounding to the nearest value.
+func (b *BlockBuilder) coordinate(nano int64) int64 {
+	g := b.granularity()
+	if nano < 0 {
+		return -((-nano + g/2) / g)
+	}
+	return (nano + g/2) / g
+}
+
+func (b *BlockBuilder) info(info *Info) *pbfproto.Info {
+	if info == nil {
+		return nil
+	}
+	version, changeset, uid := info.Version, info.Changeset, info.UID
+	timestamp := info.Timestamp / b.dateGranularity()
+	userSid := uint32(b.sid(info.User))
+	out := &pbfproto.Info{
+		Version:   &version,
+		Timestamp: &timestamp,
+		Changeset: &changeset,
+		Uid:       &uid,
+		UserSid:   &userSid,
+	}
+	if info.Visible != nil {
+		visible := *info.Visible
+		out.Visible = &visible
+	}
+	return out
+}
+
+func (b *BlockBuilder) addNode(e *Entity) {
+	dense := b.group.Dense
+	lat, lon := b.coordinate(e.Lat), b.coordinate(e.Lon)
+	dense.Id = append(dense.Id, e.ID-b.prevID)
+	dense.Lat = append(dense.Lat, lat-b.prevLat)
+	dense.Lon = append(dense.Lon, lon-b.prevLon)
+	b.prevID, b.prevLat, b.prevLon = e.ID, lat, lon
+	for _, tag := range e.Tags {
+		dense.KeysVals = append(dense.KeysVals, b.denseSid(tag.Key), b.denseSid(tag.Value))
+	}
+	dense.KeysVals = append(dense.KeysVals, 0)
+	if b.denseInfo {
+		info := dense.Denseinfo
+		timestamp := e.Info.Timestamp / b.dateGranularity()
+		userSid := b.sid(e.Info.User)
+		info.Version = append(info.Version, e.Info.Version)
+		info.Timestamp = append(info.Timestamp, timestamp-b.prevTimestamp)
+		info.Changeset = append(info.Changeset, e.Info.Changeset-b.prevChangeset)
+		info.Uid = append(info.Uid, e.Info.UID-b.prevUID)
+		info.UserSid = append(info.UserSid, userSid-b.prevUserSid)
+		b.prevTimestamp, b.prevChangeset = timestamp, e.Info.Changeset
+		b.prevUID, b.prevUserSid = e.Info.UID, userSid
+		if b.denseVisible {
+			info.Visible = append(info.Visible, *e.Info.Visible)
+		}
+	}
+}
+
+func (b *BlockBuilder) addWay(e *Entity) {
+	id := e.ID
+	way := &pbfproto.Way{
+		Id:   &id,
+		Keys: make([]uint32, len(e.Tags)),
+		Vals: make([]uint32, len(e.Tags)),
+		Info: b.info(e.Info),
+		Refs: make([]int64, len(e.Refs)),
+	}
+	for i, tag := range e.Tags {
+		way.Keys[i] = uint32(b.sid(tag.Key))
+		way.Vals[i] = uint32(b.sid(tag.Value))
+	}
+	var prev int64
+	for i, ref := range e.Refs {
+		way.Refs[i] = ref - prev
+		prev = ref
+	}
+	if len(e.RefLats) > 0 {
+		way.Lat = make([]int64, len(e.RefLats))
+		way.Lon = make([]int64, len(e.RefLons))
+		var prevLat, prevLon int64
+		for i := range e.RefLats {
+			lat, lon := b.coordinate(e.RefLats[i]), b.coordinate(e.RefLons[i])
+			way.Lat[i], way.Lon[i] = lat-prevLat, lon-prevLon
+			prevLat, prevLon = lat, lon
+		}
+	}
+	b.group.Ways = append(b.group.Ways, way)
+}
+
+func (b *BlockBuilder) addRelation(e *Entity) {
+	id := e.ID
+	rel := &pbfproto.Relation{
+		Id:       &id,
+		Keys:     make([]uint32, len(e.Tags)),
+		Vals:     make([]uint32, len(e.Tags)),
+		Info:     b.info(e.Info),
+		RolesSid: make([]int32, len(e.Members)),
+		Memids:   make([]int64, len(e.Members)),
+		Types:    make([]pbfproto.Relation_MemberType, len(e.Members)),
+	}
+	for i, tag := range e.Tags {
+		rel.Keys[i] = uint32(b.sid(tag.Key))
+		rel.Vals[i] = uint32(b.sid(tag.Value))
+	}
+	var prev int64
+	for i, member := range e.Members {
+		rel.RolesSid[i] = b.sid(member.Role)
+		rel.Memids[i] = member.ID - prev
+		rel.Types[i] = pbfproto.Relation_MemberType(member.Type)
+		prev = member.ID
+	}
+	b.group.Relations = append(b.group.Relations, rel)
+}
@@ -0,0 +1,105 @@
+package pbfio
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/codesoap/pbf-reblob/pbfproto"
+
+	"github.com/klauspost/compress/zlib"
+	"github.com/klauspost/compress/zstd"
+)
+
+type compressor struct {
+	zlibWriterPool     []*zlib.Writer
+	zlibWriterPoolLock sync.Mutex
+	zstdEncoder        *zstd.Encoder
+	zstdEncoderLock    sync.Mutex
+}
+
+func newCompressor() *compressor {
+	return &compressor{}
+}
+
+func (c *compressor) close() error {
+	var err error
+	c.zlibWriterPoolLock.Lock()
+	for _, writer := range c.zlibWriterPool {
+		if e := writer.Close(); e != nil {
+			err = e
+		}
+	}
+	c.zlibWriterPoolLock.Unlock()
+	if c.zstdEncoder != nil {
+		if e := c.zstdEncoder.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (c *compressor) toRawBlob(compression string, data []byte) ([]byte, error) {
+	switch compression {
+	case "raw":
+		blob := &pbfproto.Blob{Data: &pbfproto.Blob_Raw{Raw: data}}
+		return blob.MarshalVT()
+	case "zlib":
+		return c.toRawZlibBlob(data)
+	case "zstd":
+		return c.toRawZstdBlob(data)
+	}
+	return nil, fmt.Errorf("invalid compression '%s'", compression)
+}
+
+func (c *compressor) toRawZlibBlob(data []byte) ([]byte, error) {
+	b := rawBlobPool.Get().([]byte)[:0]
+	buf := bytes.NewBuffer(b)
+	var zlibWriter *zlib.Writer
+	c.zlibWriterPoolLock.Lock()
+	if len(c.zlibWriterPool) > 0 {
+		zlibWriter = c.zlibWriterPool[len(c.zlibWriterPool)-1]
+		zlibWriter.Reset(buf)
+		c.zlibWriterPool = c.zlibWriterPool[:len(c.zlibWriterPool)-1]
+	} else {
+		zlibWriter, _ = zlib.NewWriterLevel(buf, zlib.BestCompression)
+	}
+	c.zlibWriterPoolLock.Unlock()
+	defer func() {
+		c.zlibWriterPoolLock.Lock()
+		c.zlibWriterPool = append(c.zlibWriterPool, zlibWriter)
+		c.zlibWriterPoolLock.Unlock()
+	}()
+	if _, err := zlibWriter.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zlibWriter.Flush(); err != nil {
+		return nil, err
+	}
+	rawSize := int32(len(data))
+	blob := &pbfproto.Blob{
+		RawSize: &rawSize,
+		Data:    &pbfproto.Blob_ZlibData{ZlibData: buf.Bytes()},
+	}
+	return blob.MarshalVT()
+}
+
+func (c *compressor) toRawZstdBlob(data []byte) ([]byte, error) {
+	var err error
+	c.zstdEncoderLock.Lock()
+	if c.zstdEncoder == nil {
+		c.zstdEncoder, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	}
+	c.zstdEncoderLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	out := rawBlobPool.Get().([]byte)[:0]
+	out = c.zstdEncoder.EncodeAll(data, out)
+	rawSize := int32(len(data))
+	blob := &pbfproto.Blob{
+		RawSize: &rawSize,
+		Data:    &pbfproto.Blob_ZstdData{ZstdData: out},
+	}
+	return blob.MarshalVT()
+}
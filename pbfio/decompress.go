@@ -92,6 +92,26 @@ func (d *decompressor) toRawData(blob *pbfproto.Blob) ([]byte, error) {
 	return data, nil
 }
 
+// compressionName returns the name of the compression used for blob,
+// as used by WriterOptions.Compression.
+func compressionName(blob *pbfproto.Blob) string {
+	switch blob.Data.(type) {
+	case *pbfproto.Blob_Raw:
+		return "raw"
+	case *pbfproto.Blob_ZlibData:
+		return "zlib"
+	case *pbfproto.Blob_LzmaData:
+		return "lzma"
+	case *pbfproto.Blob_OBSOLETEBzip2Data:
+		return "bzip2"
+	case *pbfproto.Blob_Lz4Data:
+		return "lz4"
+	case *pbfproto.Blob_ZstdData:
+		return "zstd"
+	}
+	return ""
+}
+
 func (d *decompressor) returnToBlobPool(b []byte) {
 	d.blobpool.Put(b)
 }
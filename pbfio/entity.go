@@ -0,0 +1,273 @@
+package pbfio
+
+import (
+	"fmt"
+
+	"github.com/codesoap/pbf-reblob/pbfproto"
+)
+
+// EntityType is the type of an OSM entity.
+type EntityType uint8
+
+const (
+	NodeType EntityType = iota
+	WayType
+	RelationType
+)
+
+func (t EntityType) String() string {
+	switch t {
+	case NodeType:
+		return "node"
+	case WayType:
+		return "way"
+	case RelationType:
+		return "relation"
+	}
+	return fmt.Sprintf("EntityType(%d)", t)
+}
+
+// Tag is a key-value pair of an entity.
+type Tag struct {
+	Key, Value string
+}
+
+// Info holds the metadata of an entity.
+type Info struct {
+	Version   int32
+	Timestamp int64 // Milliseconds since 1970.
+	Changeset int64
+	UID       int32
+	User      string
+
+	// Visible is only set in files with the HistoricalInformation
+	// feature.
+	Visible *bool
+}
+
+// Member is a member of a relation.
+type Member struct {
+	Type EntityType
+	ID   int64
+	Role string
+}
+
+// Entity is a decoded node, way or relation. Locations are given in
+// nanodegrees.
+type Entity struct {
+	Type EntityType
+	ID   int64
+	Tags []Tag
+	Info *Info // Nil if the entity has no metadata.
+
+	Lat, Lon int64 // Only used by nodes.
+
+	Refs []int64 // Only used by ways.
+
+	// RefLats and RefLons are the locations of the nodes in Refs. They
+	// are only present in files with the LocationsOnWays feature.
+	RefLats, RefLons []int64
+
+	Members []Member // Only used by relations.
+}
+
+// Entities decodes all nodes, ways and relations of block in the order
+// they are stored. Changesets are skipped.
+func Entities(block *pbfproto.PrimitiveBlock) ([]Entity, error) {
+	d := entityDecoder{
+		strings:         block.GetStringtable().GetS(),
+		granularity:     int64(block.GetGranularity()),
+		dateGranularity: int64(block.GetDateGranularity()),
+		latOffset:       block.GetLatOffset(),
+		lonOffset:       block.GetLonOffset(),
+	}
+	var entities []Entity
+	for _, group := range block.Primitivegroup {
+		for _, node := range group.Nodes {
+			entities = append(entities, Entity{
+				Type: NodeType,
+				ID:   node.GetId(),
+				Tags: d.tags(node.Keys, node.Vals),
+				Info: d.info(node.Info),
+				Lat:  d.latOffset + d.granularity*node.GetLat(),
+				Lon:  d.lonOffset + d.granularity*node.GetLon(),
+			})
+		}
+		if group.Dense != nil {
+			entities = d.appendDense(entities, group.Dense)
+		}
+		for _, way := range group.Ways {
+			entities = append(entities, d.way(way))
+		}
+		for _, rel := range group.Relations {
+			entities = append(entities, d.relation(rel))
+		}
+	}
+	return entities, d.err
+}
+
+type entityDecoder struct {
+	strings                      [][]byte
+	granularity, dateGranularity int64
+	latOffset, lonOffset         int64
+	err                          error
+}
+
+func (d *entityDecoder) string(sid int64) string {
+	if sid < 0 || sid >= int64(len(d.strings)) {
+		if d.err == nil {
+			d.err = fmt.Errorf("string index %d out of range", sid)
+		}
+		return ""
+	}
+	return string(d.strings[sid])
+}
+
+func (d *entityDecoder) tags(keys, vals []uint32) []Tag {
+	if len(keys) != len(vals) && d.err == nil {
+		d.err = fmt.Errorf("got %d keys but %d values", len(keys), len(vals))
+	}
+	var tags []Tag
+	for i := 0; i < min(len(keys), len(vals)); i++ {
+		tags = append(tags, Tag{Key: d.string(int64(keys[i])), Value: d.string(int64(vals[i]))})
+	}
+	return tags
+}
+
+func (d *entityDecoder) info(info *pbfproto.Info) *Info {
+	if info == nil {
+		return nil
+	}
+	out := &Info{
+		Version:   info.GetVersion(),
+		Timestamp: info.GetTimestamp() * d.dateGranularity,
+		Changeset: info.GetChangeset(),
+		UID:       info.GetUid(),
+	}
+	if info.Visible != nil {
+		visible := *info.Visible
+		out.Visible = &visible
+	}
+	if info.UserSid != nil {
+		out.User = d.string(int64(info.GetUserSid()))
+	}
+	return out
+}
+
+func (d *entityDecoder) appendDense(entities []Entity, dense *pbfproto.DenseNodes) []Entity {
+	if len(dense.Lat) != len(dense.Id) || len(dense.Lon) != len(dense.Id) {
+		d.err = fmt.Errorf("dense nodes have %d IDs but %d latitudes and %d longitudes",
+			len(dense.Id), len(dense.Lat), len(dense.Lon))
+		return entities
+	}
+	info := dense.Denseinfo
+	var id, lat, lon, timestamp, changeset int64
+	var uid, userSid int32
+	kv := dense.KeysVals
+	for i := range dense.Id {
+		id += dense.Id[i]
+		lat += dense.Lat[i]
+		lon += dense.Lon[i]
+		node := Entity{
+			Type: NodeType,
+			ID:   id,
+			Lat:  d.latOffset + d.granularity*lat,
+			Lon:  d.lonOffset + d.granularity*lon,
+		}
+		for len(kv) > 1 && kv[0] != 0 {
+			node.Tags = append(node.Tags, Tag{Key: d.string(int64(kv[0])), Value: d.string(int64(kv[1]))})
+			kv = kv[2:]
+		}
+		if len(kv) > 0 {
+			kv = kv[1:]
+		}
+		if info != nil && i < len(info.Version) {
+			node.Info = &Info{Version: info.Version[i]}
+			if i < len(info.Timestamp) {
+				timestamp += info.Timestamp[i]
+				node.Info.Timestamp = timestamp * d.dateGranularity
+			}
+			if i < len(info.Changeset) {
+				changeset += info.Changeset[i]
+				node.Info.Changeset = changeset
+			}
+			if i < len(info.Uid) {
+				uid += info.Uid[i]
+				node.Info.UID = uid
+			}
+			if i < len(info.UserSid) {
+				userSid += info.UserSid[i]
+				node.Info.User = d.string(int64(userSid))
+			}
+			if i < len(info.Visible) {
+				// The block may be returned to its pool, so the flag
+				// must not point into it.
+				visible := info.Visible[i]
+				node.Info.Visible = &visible
+			}
+		}
+		entities = append(entities, node)
+	}
+	return entities
+}
+
+func (d *entityDecoder) way(way *pbfproto.Way) Entity {
+	out := Entity{
+		Type: WayType,
+		ID:   way.GetId(),
+		Tags: d.tags(way.Keys, way.Vals),
+		Info: d.info(way.Info),
+		Refs: make([]int64, len(way.Refs)),
+	}
+	var ref int64
+	for i, delta := range way.Refs {
+		ref += delta
+		out.Refs[i] = ref
+	}
+	if len(way.Lat) > 0 || len(way.Lon) > 0 {
+		if len(way.Lat) != len(way.Refs) || len(way.Lon) != len(way.Refs) {
+			if d.err == nil {
+				d.err = fmt.Errorf("way %d has %d refs but %d latitudes and %d longitudes",
+					out.ID, len(way.Refs), len(way.Lat), len(way.Lon))
+			}
+			return out
+		}
+		out.RefLats = make([]int64, len(way.Lat))
+		out.RefLons = make([]int64, len(way.Lon))
+		var lat, lon int64
+		for i := range way.Lat {
+			lat += way.Lat[i]
+			lon += way.Lon[i]
+			out.RefLats[i] = d.latOffset + d.granularity*lat
+			out.RefLons[i] = d.lonOffset + d.granularity*lon
+		}
+	}
+	return out
+}
+
+func (d *entityDecoder) relation(rel *pbfproto.Relation) Entity {
+	out := Entity{
+		Type: RelationType,
+		ID:   rel.GetId(),
+		Tags: d.tags(rel.Keys, rel.Vals),
+		Info: d.info(rel.Info),
+	}
+	if len(rel.RolesSid) != len(rel.Memids) || len(rel.Types) != len(rel.Memids) {
+		if d.err == nil {
+			d.err = fmt.Errorf("relation %d has %d members but %d roles and %d types",
+				out.ID, len(rel.Memids), len(rel.RolesSid), len(rel.Types))
+		}
+		return out
+	}
+	out.Members = make([]Member, len(rel.Memids))
+	var id int64
+	for i := range rel.Memids {
+		id += rel.Memids[i]
+		out.Members[i] = Member{
+			Type: EntityType(rel.Types[i]),
+			ID:   id,
+			Role: d.string(int64(rel.RolesSid[i])),
+		}
+	}
+	return out
+}
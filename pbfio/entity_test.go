@@ -0,0 +1,126 @@
+package pbfio
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/codesoap/pbf-reblob/pbfproto"
+)
+
+func TestBlockBuilderRoundTrip(t *testing.T) {
+	visible := false
+	want := []Entity{
+		{Type: NodeType, ID: 1, Lat: 515000000, Lon: -1200},
+		{Type: NodeType, ID: 3, Lat: -330000100, Lon: 1515000000, Tags: []Tag{{"name", ""}, {"amenity", "bench"}}},
+		{Type: NodeType, ID: 4, Info: &Info{Version: 2, Timestamp: 1700000000000, Changeset: 7, UID: 5, User: "ann"}},
+		{Type: NodeType, ID: 5, Info: &Info{Version: 3, Timestamp: 1700000001000, Changeset: 6, User: "", Visible: &visible}},
+		{Type: WayType, ID: 10, Refs: []int64{1, 3}, Tags: []Tag{{"highway", "path"}}},
+		{Type: WayType, ID: 11, Refs: []int64{4, 1}, RefLats: []int64{100, 515000000}, RefLons: []int64{-100, -1200},
+			Info: &Info{Version: 1, Timestamp: 1600000000000, Changeset: 8, UID: 5, User: "ann"}},
+		{Type: RelationType, ID: 20, Members: []Member{{WayType, 10, "outer"}, {NodeType, 1, ""}, {RelationType, 21, "sub"}}},
+		{Type: NodeType, ID: 30},
+	}
+	var b BlockBuilder
+	for i := range want {
+		if !b.Fits(&want[i], 1<<20) {
+			t.Fatalf("entity %d does not fit", i)
+		}
+		b.Add(&want[i])
+	}
+	block := b.Build()
+	if len(block.Primitivegroup) != 6 {
+		t.Errorf("got %d groups, want 6", len(block.Primitivegroup))
+	}
+	got, err := Entities(block)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(got, want) {
+		t.Errorf("entities differ after round trip:\ngot  %+v\nwant %+v", got, want)
+	}
+	if b.Build() != nil {
+		t.Errorf("builder is not empty after Build")
+	}
+}
+
+func TestBlockBuilderFits(t *testing.T) {
+	var b BlockBuilder
+	for i := 0; i < 10000; i++ {
+		node := Entity{Type: NodeType, ID: int64(i), Lat: int64(i) * 1000, Tags: []Tag{{"ref", string(rune('a' + i%26))}}}
+		if !b.Fits(&node, 4096) {
+			if size := b.Build().SizeVT(); size >= 4096 || size < 2048 {
+				t.Fatalf("got block of size %d", size)
+			}
+		}
+		b.Add(&node)
+	}
+}
+
+func TestBlockBuilderEmptyStrings(t *testing.T) {
+	entities := []Entity{
+		{Type: NodeType, ID: 1, Tags: []Tag{{"note", ""}}},
+		{Type: NodeType, ID: 2, Tags: []Tag{{"fixme", ""}}},
+		{Type: WayType, ID: 3, Tags: []Tag{{"name", ""}}},
+		{Type: RelationType, ID: 4, Members: []Member{{NodeType, 1, ""}, {NodeType, 2, ""}}},
+	}
+	var b BlockBuilder
+	for i := range entities {
+		b.Add(&entities[i])
+	}
+	block := b.Build()
+	var empty int
+	for _, s := range block.Stringtable.S {
+		if len(s) == 0 {
+			empty++
+		}
+	}
+	// The unused first string and one for the tags of dense nodes.
+	if empty != 2 {
+		t.Errorf("got %d empty strings, want 2", empty)
+	}
+	got, err := Entities(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range got {
+		if !reflect.DeepEqual(got[i].Tags, entities[i].Tags) || !reflect.DeepEqual(got[i].Members, entities[i].Members) {
+			t.Errorf("entity %d differs after round trip: got %+v, want %+v", i, got[i], entities[i])
+		}
+	}
+}
+
+func TestEntitiesOfPooledBlocks(t *testing.T) {
+	// Decoded entities must not refer to blocks, that have been returned
+	// to the pool and are overwritten by the next block.
+	marshal := func(visible bool) []byte {
+		var b BlockBuilder
+		for id := int64(1); id <= 3; id++ {
+			b.Add(&Entity{Type: NodeType, ID: id, Info: &Info{Version: 1, Visible: &visible}})
+		}
+		data, err := b.Build().MarshalVT()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	deleted, visible := marshal(false), marshal(true)
+	var got []Entity
+	for i := 0; i < 10; i++ {
+		for _, data := range [][]byte{deleted, visible} {
+			block := pbfproto.PrimitiveBlockFromVTPool()
+			if err := block.UnmarshalVT(data); err != nil {
+				t.Fatal(err)
+			}
+			entities, err := Entities(block)
+			if err != nil {
+				t.Fatal(err)
+			}
+			block.ReturnToVTPool()
+			got = append(got, entities...)
+		}
+	}
+	for i, e := range got {
+		if want := i/3%2 == 1; *e.Info.Visible != want {
+			t.Fatalf("entity %d has visible %t, want %t", i, *e.Info.Visible, want)
+		}
+	}
+}
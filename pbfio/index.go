@@ -0,0 +1,186 @@
+package pbfio
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// indexMagic is written at the start of every index file.
+var indexMagic = []byte("PBFIDX1\n")
+
+// IndexEntry describes one blob of a PBF file. It contains everything
+// needed to read the blob with a BlobReader.
+type IndexEntry struct {
+	Offset     int64  // File offset of the length prefix of the BlobHeader.
+	HeaderSize int    // Size of the marshalled BlobHeader.
+	DataSize   int    // Size of the marshalled Blob.
+	Type       string // The type from the BlobHeader, e.g. "OSMData".
+
+	// Summary is only filled for blobs of type OSMData.
+	Summary
+}
+
+// BuildIndex reads all blobs of inFile and returns an IndexEntry for
+// each of them.
+func BuildIndex(inFile string, opts ReaderOptions) ([]IndexEntry, error) {
+	blobs := make(chan DecodedBlob)
+	go StreamBlobs(inFile, opts, blobs)
+	var entries []IndexEntry
+	var err error
+	for blob := range blobs {
+		if err != nil {
+			// Drain blobs, so that StreamBlobs can finish.
+			continue
+		} else if blob.Err != nil {
+			err = blob.Err
+			continue
+		}
+		entry := IndexEntry{
+			Offset:     blob.Offset,
+			HeaderSize: blob.HeaderSize,
+			DataSize:   blob.DataSize,
+			Type:       blob.BlobHeader.GetType(),
+		}
+		if blob.PrimitiveBlock != nil {
+			entry.Summary = Summarize(blob.PrimitiveBlock)
+			blob.PrimitiveBlock.ReturnToVTPool()
+		}
+		entries = append(entries, entry)
+	}
+	return entries, err
+}
+
+// WriteIndex writes entries to w in a compact binary format, which can
+// be read with ReadIndex.
+func WriteIndex(w io.Writer, entries []IndexEntry) error {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(indexMagic); err != nil {
+		return err
+	}
+	var buf []byte
+	for _, entry := range entries {
+		buf = binary.AppendUvarint(buf[:0], uint64(entry.Offset))
+		buf = binary.AppendUvarint(buf, uint64(entry.HeaderSize))
+		buf = binary.AppendUvarint(buf, uint64(entry.DataSize))
+		buf = binary.AppendUvarint(buf, uint64(len(entry.Type)))
+		buf = append(buf, entry.Type...)
+		buf = entry.Summary.appendBinary(buf)
+		if _, err := bw.Write(buf); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// ReadIndex reads entries, that have been written with WriteIndex,
+// from r.
+func ReadIndex(r io.Reader) ([]IndexEntry, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(indexMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, fmt.Errorf("could not read index magic: %v", err)
+	} else if !bytes.Equal(magic, indexMagic) {
+		return nil, fmt.Errorf("not an index file")
+	}
+	var entries []IndexEntry
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			return entries, nil
+		}
+		entry, err := readIndexEntry(br)
+		if err != nil {
+			return entries, fmt.Errorf("could not read index entry %d: %v", len(entries), err)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+func readIndexEntry(r *bufio.Reader) (IndexEntry, error) {
+	var entry IndexEntry
+	var offset, headerSize, dataSize, typeLen uint64
+	for _, v := range []*uint64{&offset, &headerSize, &dataSize, &typeLen} {
+		var err error
+		if *v, err = binary.ReadUvarint(r); err != nil {
+			return entry, noEOF(err)
+		}
+	}
+	if typeLen > maxBlobHeaderSize {
+		return entry, fmt.Errorf("type is too long")
+	}
+	typ := make([]byte, typeLen)
+	if _, err := io.ReadFull(r, typ); err != nil {
+		return entry, noEOF(err)
+	}
+	entry.Offset = int64(offset)
+	entry.HeaderSize = int(headerSize)
+	entry.DataSize = int(dataSize)
+	entry.Type = string(typ)
+	var err error
+	entry.Summary, err = readSummary(r)
+	return entry, err
+}
+
+// appendBinary appends a compact encoding of s to buf. Only the ID
+// ranges of present entity types and, if nodes are present, the
+// bounding box are stored.
+func (s Summary) appendBinary(buf []byte) []byte {
+	for _, r := range []IDRange{s.Nodes, s.Ways, s.Relations} {
+		buf = binary.AppendUvarint(buf, uint64(r.Count))
+		if r.Count > 0 {
+			buf = binary.AppendVarint(buf, r.Min)
+			buf = binary.AppendVarint(buf, r.Max-r.Min)
+		}
+	}
+	if s.Nodes.Count > 0 {
+		buf = binary.AppendVarint(buf, s.BBox.Left)
+		buf = binary.AppendVarint(buf, s.BBox.Right-s.BBox.Left)
+		buf = binary.AppendVarint(buf, s.BBox.Bottom)
+		buf = binary.AppendVarint(buf, s.BBox.Top-s.BBox.Bottom)
+	}
+	return buf
+}
+
+func readSummary(r io.ByteReader) (Summary, error) {
+	var s Summary
+	for _, idRange := range []*IDRange{&s.Nodes, &s.Ways, &s.Relations} {
+		count, err := binary.ReadUvarint(r)
+		if err != nil {
+			return s, noEOF(err)
+		}
+		idRange.Count = int(count)
+		if count == 0 {
+			continue
+		}
+		if idRange.Min, err = binary.ReadVarint(r); err != nil {
+			return s, noEOF(err)
+		}
+		if idRange.Max, err = binary.ReadVarint(r); err != nil {
+			return s, noEOF(err)
+		}
+		idRange.Max += idRange.Min
+	}
+	if s.Nodes.Count > 0 {
+		var v [4]int64
+		for i := range v {
+			var err error
+			if v[i], err = binary.ReadVarint(r); err != nil {
+				return s, noEOF(err)
+			}
+		}
+		s.BBox = BBox{Left: v[0], Right: v[0] + v[1], Bottom: v[2], Top: v[2] + v[3]}
+	}
+	return s, nil
+}
+
+// noEOF turns io.EOF into io.ErrUnexpectedEOF, for data that must be
+// complete.
+func noEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,59 @@
+package pbfio
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestIndexRoundTrip(t *testing.T) {
+	inFile := filepath.Join(t.TempDir(), "in.osm.pbf")
+	blobs := testBlobs(30)
+	if err := writeTestBlobs(inFile, WriterOptions{Compression: "zstd"}, blobs); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := BuildIndex(inFile, ReaderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(entries) != len(blobs) {
+		t.Fatalf("got %d index entries, want %d", len(entries), len(blobs))
+	}
+	var buf bytes.Buffer
+	if err = WriteIndex(&buf, entries); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	got, err := ReadIndex(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(got, entries) {
+		t.Errorf("index differs after round trip:\ngot  %+v\nwant %+v", got, entries)
+	}
+	if _, err = ReadIndex(bytes.NewReader(data[:len(data)-1])); err == nil {
+		t.Errorf("truncated index was read without error")
+	}
+	if _, err = ReadIndex(bytes.NewReader([]byte("PBFIDX0\n"))); err == nil {
+		t.Errorf("index with wrong magic was read without error")
+	}
+
+	// The entries must be sufficient to read the blobs directly.
+	file, err := os.Open(inFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader := NewBlobReader(file)
+	defer reader.Close()
+	for i, entry := range got {
+		blob, err := reader.ReadBlob(entry.Offset)
+		if err != nil {
+			t.Fatalf("entry %d: %v", i, err)
+		} else if blob.BlobHeader.GetType() != entry.Type || blob.DataSize != entry.DataSize || blob.HeaderSize != entry.HeaderSize {
+			t.Errorf("entry %d does not describe blob at offset %d", i, entry.Offset)
+		} else if i > 0 && Summarize(blob.PrimitiveBlock) != entry.Summary {
+			t.Errorf("entry %d has summary %+v, want %+v", i, entry.Summary, Summarize(blob.PrimitiveBlock))
+		}
+	}
+}
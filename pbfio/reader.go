@@ -16,28 +16,90 @@ import (
 // See https://wiki.openstreetmap.org/wiki/PBF_Format#File_format
 const maxBlobHeaderSize = 64 * 1024
 
-var blobHeaderMem []byte
 var rawBlobPool = sync.Pool{New: func() any { return make([]byte, 0, 10*1024) }}
 
 type undecodedBlob struct {
 	decompressor *decompressor
 	blobHeader   *pbfproto.BlobHeader
 	blob         []byte
+	index        int
+	offset       int64
+	headerSize   int
+	keepRaw      bool
 }
 
 type DecodedBlob struct {
 	Err        error // Any error that might have occurred when reading the blob.
 	BlobHeader *pbfproto.BlobHeader
 
+	Index      int   // Sequential index of the blob; skipped regions are not counted.
+	Offset     int64 // File offset of the length prefix of the BlobHeader.
+	HeaderSize int   // Size of the marshalled BlobHeader.
+	DataSize   int   // Size of the marshalled Blob.
+	RawSize    int   // Size of the uncompressed data.
+
+	Compression string // The compression of the Blob as it was read.
+
+	// RawBlob is the marshalled Blob as it was read. It is only set if
+	// ReaderOptions.KeepRaw was used. Whoever modifies the blob's
+	// HeaderBlock or PrimitiveBlock must set RawBlob to nil.
+	RawBlob []byte
+
 	// Either HeaderBlock or PrimitiveGroup will be nil.
 	HeaderBlock    *pbfproto.HeaderBlock
 	PrimitiveBlock *pbfproto.PrimitiveBlock
 }
 
+// ReaderOptions modify the behaviour of StreamBlobs.
+type ReaderOptions struct {
+	// Resync enables recovery from damaged files: Blobs that cannot be
+	// read or decoded are skipped and the next plausible BlobHeader is
+	// searched for, instead of aborting.
+	Resync bool
+
+	// Warn, if not nil, is called for every problem that was recovered
+	// from. It may be called concurrently.
+	Warn func(err error)
+
+	// KeepRaw enables keeping the marshalled Blob in
+	// DecodedBlob.RawBlob, so that it can be written again without
+	// being recompressed.
+	KeepRaw bool
+
+	// Filter, if not nil, is called for every blob, whose BlobHeader
+	// carries indexdata that was written by WriteBlobs. If it returns
+	// false, the blob is skipped without being decompressed.
+	Filter func(s Summary) bool
+}
+
+func (o ReaderOptions) warn(err error) {
+	if o.Warn != nil {
+		o.Warn(err)
+	}
+}
+
+// IndexData returns the Summary stored in the indexdata field of the
+// BlobHeader of b. If the field was not written by WriteBlobs, ok is
+// false.
+func (b DecodedBlob) IndexData() (s Summary, ok bool) {
+	return ParseIndexData(b.BlobHeader.GetIndexdata())
+}
+
+// Position describes where b is located in the input file. It is
+// intended for messages.
+func (b DecodedBlob) Position() string {
+	return position(b.Index, b.Offset)
+}
+
+func position(index int, offset int64) string {
+	return fmt.Sprintf("blob %d at offset %d", index, offset)
+}
+
 // StreamBlobs will parse individual blobs from inFile and return them
 // on the ret channel. If any error occurs, ret.Err will bet set and
-// reading will abort. StreamBlobs will close ret.
-func StreamBlobs(inFile string, ret chan DecodedBlob) {
+// reading will abort, unless opts.Resync is set. StreamBlobs will close
+// ret.
+func StreamBlobs(inFile string, opts ReaderOptions, ret chan DecodedBlob) {
 	defer close(ret)
 	decompressor := newDecompressor()
 	defer decompressor.close()
@@ -52,53 +114,65 @@ func StreamBlobs(inFile string, ret chan DecodedBlob) {
 	defer file.Close()
 	dataDecoder := lineworker.NewWorkerPool(runtime.NumCPU(), decodeBlob)
 
+	// stop tells feedBlobsWithHeaders to quit after a blob could not be
+	// decoded. Only it may stop dataDecoder, because Process must not
+	// be called after Stop.
+	stop := make(chan struct{})
 	errs := make(chan error)
-	go feedBlobsWithHeaders(file, decompressor, dataDecoder, errs)
+	go feedBlobsWithHeaders(file, opts, decompressor, dataDecoder, stop, errs)
 
 	results := make(chan DecodedBlob)
-	go channelResults(dataDecoder, results)
+	go channelResults(dataDecoder, opts, stop, results)
 
-	for loop := true; loop; {
+	// After the first error, everything else is discarded until both
+	// goroutines are done, so that the decompressor is not closed while
+	// it is still in use.
+	failed := false
+	for errs != nil || results != nil {
 		select {
 		case err, ok := <-errs:
-			if loop = !ok; !loop {
-				ret <- DecodedBlob{Err: err}
-				dataDecoder.Stop()
-				dataDecoder.DiscardWork()
-			} else {
+			if !ok {
 				errs = nil
+			} else if !failed {
+				failed = true
+				ret <- DecodedBlob{Err: err}
 			}
 		case res, ok := <-results:
-			if ok {
-				ret <- res
-				if loop = res.Err == nil; !loop {
-					dataDecoder.Stop()
-					dataDecoder.DiscardWork()
-				}
-			} else {
+			if !ok {
 				results = nil
+			} else if !failed {
+				failed = res.Err != nil
+				ret <- res
 			}
 		}
-		if errs == nil && results == nil {
-			break
-		}
 	}
 }
 
 func decodeBlob(in *undecodedBlob) (DecodedBlob, error) {
-	defer rawBlobPool.Put(in.blob)
 	// Note that out.err is not set here. Instead errors are returned.
 	// The returned error will be filled into out.err in channelResults.
-	out := DecodedBlob{}
+	out := DecodedBlob{
+		Index:      in.index,
+		Offset:     in.offset,
+		HeaderSize: in.headerSize,
+		DataSize:   len(in.blob),
+	}
+	if in.keepRaw {
+		out.RawBlob = in.blob
+	} else {
+		defer rawBlobPool.Put(in.blob)
+	}
 	blob := &pbfproto.Blob{}
 	if err := blob.UnmarshalVT(in.blob); err != nil {
 		return out, err
 	}
+	out.Compression = compressionName(blob)
 	data, err := in.decompressor.toRawData(blob)
 	if err != nil {
 		return out, err
 	}
 	defer in.decompressor.returnToBlobPool(data)
+	out.RawSize = len(data)
 	switch *in.blobHeader.Type {
 	case "OSMHeader":
 		out.BlobHeader = in.blobHeader
@@ -114,59 +188,122 @@ func decodeBlob(in *undecodedBlob) (DecodedBlob, error) {
 	}
 }
 
-func feedBlobsWithHeaders(file *os.File, decompressor *decompressor, decoder *lineworker.WorkerPool[*undecodedBlob, DecodedBlob], errs chan error) {
+func feedBlobsWithHeaders(file *os.File, opts ReaderOptions, decompressor *decompressor, decoder *lineworker.WorkerPool[*undecodedBlob, DecodedBlob], stop chan struct{}, errs chan error) {
 	defer close(errs)
 	defer decoder.Stop()
-	for {
-		blobHeaderSize, err := getBlobHeaderSize(file)
+	var offset int64
+	var blobHeaderMem []byte
+	for index := 0; ; {
+		ub, size, err := readUndecodedBlob(file, decompressor, &blobHeaderMem)
 		if err == io.EOF {
 			return
+		} else if err != nil && opts.Resync {
+			pos := position(index, offset)
+			next, err2 := findNextBlobHeader(file, offset+1)
+			if err2 == io.EOF {
+				opts.warn(fmt.Errorf("%s: %v; no further blobs found", pos, err))
+				return
+			} else if err2 != nil {
+				errs <- fmt.Errorf("%s: could not search for next blob: %v", pos, err2)
+				return
+			}
+			opts.warn(fmt.Errorf("%s: %v; skipped %d bytes", pos, err, next-offset))
+			if _, err = file.Seek(next, io.SeekStart); err != nil {
+				errs <- fmt.Errorf("%s: could not seek to next blob: %v", pos, err)
+				return
+			}
+			offset = next
+			continue
 		} else if err != nil {
-			errs <- fmt.Errorf("could not read blob header size: %v", err)
+			errs <- fmt.Errorf("%s: %v", position(index, offset), err)
 			return
 		}
-		blobHeaderMem, err = readAllIntoBuf(io.LimitReader(file, int64(blobHeaderSize)), blobHeaderMem)
-		if err != nil {
-			errs <- fmt.Errorf("could not read BlobHeader: %v", err)
-			return
+		ub.index = index
+		ub.offset = offset
+		ub.keepRaw = opts.KeepRaw
+		offset += size
+		index++
+		if opts.Filter != nil {
+			if summary, ok := ParseIndexData(ub.blobHeader.Indexdata); ok && !opts.Filter(summary) {
+				rawBlobPool.Put(ub.blob)
+				continue
+			}
 		}
-		ub := &undecodedBlob{decompressor: decompressor}
-		ub.blobHeader = &pbfproto.BlobHeader{}
-		if err = ub.blobHeader.UnmarshalVT(blobHeaderMem); err != nil {
-			errs <- fmt.Errorf("could not unmarshal BlobHeader: %v", err)
+		select {
+		case <-stop:
+			rawBlobPool.Put(ub.blob)
 			return
+		default:
 		}
-		if ub.blobHeader.Type == nil {
-			errs <- fmt.Errorf("fileblock is missing type")
+		if !decoder.Process(ub) {
+			// The decoder is not accepting work anymore; there must be
+			// a problem elsewhere. Stop reading blobs.
 			return
-		} else {
-			ub.blob = rawBlobPool.Get().([]byte)
-			ub.blob, err = readAllIntoBuf(io.LimitReader(file, int64(*ub.blobHeader.Datasize)), ub.blob)
-			if err != nil {
-				errs <- fmt.Errorf("could not read blob from file: %v", err)
-				return
-			}
-			if !decoder.Process(ub) {
-				// The decoder is not accepting work anymore; there must be
-				// a problem elsewhere. Stop reading blobs.
-				return
-			}
 		}
 	}
 }
 
-func channelResults(decoder *lineworker.WorkerPool[*undecodedBlob, DecodedBlob], results chan DecodedBlob) {
+// readUndecodedBlob reads the next BlobHeader and Blob from file. It
+// returns the amount of bytes read. If file is at its end, io.EOF is
+// returned. blobHeaderMem is reused for reading the BlobHeader.
+func readUndecodedBlob(file *os.File, decompressor *decompressor, blobHeaderMem *[]byte) (*undecodedBlob, int64, error) {
+	blobHeaderSize, err := getBlobHeaderSize(file)
+	if err == io.EOF {
+		return nil, 0, err
+	} else if err != nil {
+		return nil, 0, fmt.Errorf("could not read blob header size: %v", err)
+	}
+	*blobHeaderMem, err = readAllIntoBuf(io.LimitReader(file, int64(blobHeaderSize)), *blobHeaderMem)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not read BlobHeader: %v", err)
+	} else if len(*blobHeaderMem) < int(blobHeaderSize) {
+		return nil, 0, fmt.Errorf("BlobHeader is truncated")
+	}
+	ub := &undecodedBlob{decompressor: decompressor, headerSize: int(blobHeaderSize)}
+	ub.blobHeader = &pbfproto.BlobHeader{}
+	if err = ub.blobHeader.UnmarshalVT(*blobHeaderMem); err != nil {
+		return nil, 0, fmt.Errorf("could not unmarshal BlobHeader: %v", err)
+	}
+	if ub.blobHeader.Type == nil {
+		return nil, 0, fmt.Errorf("fileblock is missing type")
+	} else if ub.blobHeader.Datasize == nil {
+		return nil, 0, fmt.Errorf("fileblock is missing datasize")
+	} else if ub.blobHeader.GetDatasize() < 0 || ub.blobHeader.GetDatasize() > maxDatasize {
+		return nil, 0, fmt.Errorf("invalid datasize %d", ub.blobHeader.GetDatasize())
+	}
+	ub.blob = rawBlobPool.Get().([]byte)
+	ub.blob, err = readAllIntoBuf(io.LimitReader(file, int64(*ub.blobHeader.Datasize)), ub.blob)
+	if err != nil {
+		rawBlobPool.Put(ub.blob)
+		return nil, 0, fmt.Errorf("could not read blob from file: %v", err)
+	} else if len(ub.blob) < int(*ub.blobHeader.Datasize) {
+		rawBlobPool.Put(ub.blob)
+		return nil, 0, fmt.Errorf("blob is truncated")
+	}
+	size := 4 + int64(blobHeaderSize) + int64(*ub.blobHeader.Datasize)
+	return ub, size, nil
+}
+
+func channelResults(decoder *lineworker.WorkerPool[*undecodedBlob, DecodedBlob], opts ReaderOptions, stop chan struct{}, results chan DecodedBlob) {
 	defer close(results)
 	for {
 		res, err := decoder.Next()
 		if err == lineworker.EOS {
 			break
+		} else if err != nil && opts.Resync {
+			opts.warn(fmt.Errorf("%s: skipping blob that could not be decoded: %v", res.Position(), err))
+			continue
+		} else if err != nil {
+			err = fmt.Errorf("%s: %v", res.Position(), err)
 		}
 		res.Err = err
 		results <- res
 		if res.Err != nil {
-			decoder.Stop()
-			decoder.DiscardWork()
+			// Keep consuming results, so that feedBlobsWithHeaders is
+			// not blocked in Process and sees stop.
+			close(stop)
+			for _, err = decoder.Next(); err != lineworker.EOS; _, err = decoder.Next() {
+			}
 			break
 		}
 	}
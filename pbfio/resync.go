@@ -0,0 +1,83 @@
+package pbfio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/codesoap/pbf-reblob/pbfproto"
+)
+
+// See https://wiki.openstreetmap.org/wiki/PBF_Format#File_format
+const maxDatasize = 32 * 1024 * 1024
+
+// osmDataHeaderPrefix is the beginning of every marshalled BlobHeader of
+// type OSMData: field 1 with a length of 7, followed by "OSMData".
+// Strictly speaking fields may appear in any order, but all known
+// writers put the type first.
+var osmDataHeaderPrefix = []byte("\x0a\x07OSMData")
+
+// findNextBlobHeader searches file for the next plausible BlobHeader of
+// type OSMData, starting at offset from. It returns the offset of the
+// header's length prefix. If no BlobHeader can be found, io.EOF is
+// returned.
+func findNextBlobHeader(file *os.File, from int64) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	fileSize := info.Size()
+	buf := make([]byte, 1024*1024)
+	for pos := from; pos < fileSize; {
+		n, err := file.ReadAt(buf, pos)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		chunk := buf[:n]
+		for i := 0; ; {
+			j := bytes.Index(chunk[i:], osmDataHeaderPrefix)
+			if j < 0 {
+				break
+			}
+			candidate := pos + int64(i+j) - 4
+			if candidate >= from && isPlausibleBlobHeader(file, candidate, fileSize) {
+				return candidate, nil
+			}
+			i += j + 1
+		}
+		if pos+int64(n) >= fileSize {
+			break
+		}
+		// Let chunks overlap, so that prefixes on chunk borders are found.
+		pos += int64(n - len(osmDataHeaderPrefix) + 1)
+	}
+	return 0, io.EOF
+}
+
+// isPlausibleBlobHeader checks whether a valid OSMData BlobHeader, which
+// references data that fits into the file, starts at offset.
+func isPlausibleBlobHeader(file *os.File, offset, fileSize int64) bool {
+	buf := make([]byte, 4)
+	if _, err := file.ReadAt(buf, offset); err != nil {
+		return false
+	}
+	headerSize := binary.BigEndian.Uint32(buf)
+	if headerSize == 0 || headerSize >= maxBlobHeaderSize {
+		return false
+	}
+	buf = make([]byte, headerSize)
+	if _, err := file.ReadAt(buf, offset+4); err != nil {
+		return false
+	}
+	header := &pbfproto.BlobHeader{}
+	if err := header.UnmarshalVT(buf); err != nil {
+		return false
+	}
+	if header.GetType() != "OSMData" ||
+		header.GetDatasize() <= 0 ||
+		header.GetDatasize() > maxDatasize {
+		return false
+	}
+	return offset+4+int64(headerSize)+int64(header.GetDatasize()) <= fileSize
+}
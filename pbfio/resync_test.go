@@ -0,0 +1,210 @@
+package pbfio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/codesoap/pbf-reblob/pbfproto"
+)
+
+func TestResync(t *testing.T) {
+	dir := t.TempDir()
+	inFile := filepath.Join(dir, "in.osm.pbf")
+	if err := writeTestBlobs(inFile, WriterOptions{Compression: "zlib"}, testBlobs(30)); err != nil {
+		t.Fatal(err)
+	}
+	var offsets []int64
+	blobs := make(chan DecodedBlob)
+	go StreamBlobs(inFile, ReaderOptions{}, blobs)
+	for blob := range blobs {
+		if blob.Err != nil {
+			t.Fatal(blob.Err)
+		}
+		offsets = append(offsets, blob.Offset)
+	}
+	data, err := os.ReadFile(inFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Insert garbage before blob 10, destroy the framing of blob 20 and
+	// truncate blob 30.
+	garbage := bytes.Repeat([]byte{0xff, 0, 0x0a}, 100)
+	copy(data[offsets[20]:], bytes.Repeat([]byte{0xff}, 8))
+	damaged := slices.Concat(data[:offsets[10]], garbage, data[offsets[10]:len(data)-10])
+	damagedFile := filepath.Join(dir, "damaged.osm.pbf")
+	if err = os.WriteFile(damagedFile, damaged, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	blobs = make(chan DecodedBlob)
+	go StreamBlobs(damagedFile, ReaderOptions{}, blobs)
+	var failed bool
+	for blob := range blobs {
+		failed = failed || blob.Err != nil
+	}
+	if !failed {
+		t.Errorf("damaged file was read without error")
+	}
+
+	var warnings atomic.Int32
+	opts := ReaderOptions{Resync: true, Warn: func(err error) { warnings.Add(1) }}
+	blobs = make(chan DecodedBlob)
+	go StreamBlobs(damagedFile, opts, blobs)
+	var got []int64
+	for blob := range blobs {
+		if blob.Err != nil {
+			t.Fatal(blob.Err)
+		} else if blob.PrimitiveBlock == nil {
+			continue
+		}
+		// Blob i of the original file starts with node (i-1)*3.
+		i := Summarize(blob.PrimitiveBlock).Nodes.Min/3 + 1
+		want := offsets[i]
+		if i >= 10 {
+			want += int64(len(garbage))
+		}
+		if blob.Offset != want {
+			t.Errorf("blob %d was found at offset %d, want %d", i, blob.Offset, want)
+		}
+		got = append(got, i)
+	}
+	var want []int64
+	for i := int64(1); i < 30; i++ {
+		if i != 20 {
+			want = append(want, i)
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("recovered blobs %v, want %v", got, want)
+	}
+	if warnings.Load() != 3 {
+		t.Errorf("got %d warnings, want 3", warnings.Load())
+	}
+}
+
+// testLayout parses the framing of the blobs in data without the reader,
+// so that the positions reported by it can be checked.
+func testLayout(t *testing.T, data []byte) []IndexEntry {
+	var layout []IndexEntry
+	for offset := int64(0); offset < int64(len(data)); {
+		headerSize := int(binary.BigEndian.Uint32(data[offset:]))
+		var header pbfproto.BlobHeader
+		if err := header.UnmarshalVT(data[offset+4 : offset+4+int64(headerSize)]); err != nil {
+			t.Fatal(err)
+		}
+		entry := IndexEntry{Offset: offset, HeaderSize: headerSize, DataSize: int(header.GetDatasize())}
+		layout = append(layout, entry)
+		offset += 4 + int64(entry.HeaderSize) + int64(entry.DataSize)
+	}
+	return layout
+}
+
+func TestPositions(t *testing.T) {
+	dir := t.TempDir()
+	inFile := filepath.Join(dir, "in.osm.pbf")
+	if err := writeTestBlobs(inFile, WriterOptions{Compression: "zlib"}, testBlobs(20)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(inFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout := testLayout(t, data)
+	garbage := bytes.Repeat([]byte{0xff, 0, 0x0a}, 100)
+
+	tests := []struct {
+		name    string
+		damage  func() []byte
+		index   int   // Index of the damaged blob.
+		skipped int   // Bytes skipped when resyncing.
+		decoded bool  // Whether the damaged blob is recovered.
+		shift   int64 // Shift of the blobs after the damaged one.
+	}{
+		{"intact", func() []byte { return data }, -1, 0, true, 0},
+		{"garbage", func() []byte {
+			return slices.Concat(data[:layout[5].Offset], garbage, data[layout[5].Offset:])
+		}, 5, len(garbage), true, int64(len(garbage))},
+		{"undecodable", func() []byte {
+			damaged := slices.Clone(data)
+			start := layout[12].Offset + 4 + int64(layout[12].HeaderSize)
+			copy(damaged[start:], bytes.Repeat([]byte{0xff}, layout[12].DataSize))
+			return damaged
+		}, 12, 0, false, 0},
+	}
+	for _, test := range tests {
+		damagedFile := filepath.Join(dir, test.name+".osm.pbf")
+		if err = os.WriteFile(damagedFile, test.damage(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		var want string
+		if test.index >= 0 {
+			want = position(test.index, layout[test.index].Offset) + ": "
+		}
+
+		blobs := make(chan DecodedBlob)
+		go StreamBlobs(damagedFile, ReaderOptions{}, blobs)
+		var errs []string
+		for blob := range blobs {
+			if blob.Err != nil {
+				errs = append(errs, blob.Err.Error())
+			}
+		}
+		if want == "" && len(errs) > 0 || want != "" && (len(errs) != 1 || !strings.HasPrefix(errs[0], want)) {
+			t.Errorf("%s: got errors %q; want one starting with '%s'", test.name, errs, want)
+		}
+
+		var mu sync.Mutex
+		var warnings []string
+		opts := ReaderOptions{Resync: true, Warn: func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			warnings = append(warnings, err.Error())
+		}}
+		blobs = make(chan DecodedBlob)
+		go StreamBlobs(damagedFile, opts, blobs)
+		var got []int
+		for blob := range blobs {
+			if blob.Err != nil {
+				t.Fatalf("%s: %v", test.name, blob.Err)
+			}
+			got = append(got, blob.Index)
+			wantEntry := layout[blob.Index]
+			if blob.Index >= test.index && test.index >= 0 {
+				wantEntry.Offset += test.shift
+			}
+			if blob.Offset != wantEntry.Offset || blob.HeaderSize != wantEntry.HeaderSize || blob.DataSize != wantEntry.DataSize {
+				t.Errorf("%s: blob %d has offset %d and sizes %d+%d; want %d and %d+%d", test.name, blob.Index,
+					blob.Offset, blob.HeaderSize, blob.DataSize, wantEntry.Offset, wantEntry.HeaderSize, wantEntry.DataSize)
+			}
+			if wantPos := position(blob.Index, wantEntry.Offset); blob.Position() != wantPos {
+				t.Errorf("%s: got position '%s'; want '%s'", test.name, blob.Position(), wantPos)
+			}
+			if blob.PrimitiveBlock != nil {
+				blob.PrimitiveBlock.ReturnToVTPool()
+			}
+		}
+		var wantIndexes []int
+		for i := range layout {
+			if i != test.index || test.decoded {
+				wantIndexes = append(wantIndexes, i)
+			}
+		}
+		if !slices.Equal(got, wantIndexes) {
+			t.Errorf("%s: got blobs %v; want %v", test.name, got, wantIndexes)
+		}
+		if want == "" && len(warnings) > 0 || want != "" && (len(warnings) != 1 || !strings.HasPrefix(warnings[0], want)) {
+			t.Errorf("%s: got warnings %q; want one starting with '%s'", test.name, warnings, want)
+		} else if test.skipped > 0 && !strings.Contains(warnings[0], fmt.Sprintf("skipped %d bytes", test.skipped)) {
+			t.Errorf("%s: got warning '%s'; want %d skipped bytes", test.name, warnings[0], test.skipped)
+		}
+	}
+}
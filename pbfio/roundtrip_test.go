@@ -0,0 +1,104 @@
+package pbfio
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/codesoap/pbf-reblob/pbfproto"
+)
+
+func testBlobs(count int) []DecodedBlob {
+	headerType, dataType := "OSMHeader", "OSMData"
+	blobs := []DecodedBlob{{
+		BlobHeader:  &pbfproto.BlobHeader{Type: &headerType},
+		HeaderBlock: &pbfproto.HeaderBlock{RequiredFeatures: []string{"OsmSchema-V0.6", "DenseNodes"}},
+	}}
+	for i := 0; i < count; i++ {
+		id := int64(i * 3)
+		block := &pbfproto.PrimitiveBlock{
+			Stringtable: &pbfproto.StringTable{S: [][]byte{{}, []byte(fmt.Sprint("s", i))}},
+			Primitivegroup: []*pbfproto.PrimitiveGroup{{
+				Dense: &pbfproto.DenseNodes{
+					Id:       []int64{id, 1, 1},
+					Lat:      []int64{int64(i), 5, -2},
+					Lon:      []int64{int64(-i), 3, 1},
+					KeysVals: []int32{1, 1, 0, 0, 0},
+				},
+			}},
+		}
+		blobs = append(blobs, DecodedBlob{
+			BlobHeader:     &pbfproto.BlobHeader{Type: &dataType},
+			PrimitiveBlock: block,
+		})
+	}
+	return blobs
+}
+
+// writeTestBlobs writes blobs to outFile and returns the first error.
+func writeTestBlobs(outFile string, opts WriterOptions, blobs []DecodedBlob) error {
+	ch := make(chan DecodedBlob)
+	errs := make(chan error)
+	go WriteBlobs(outFile, opts, ch, errs)
+	for _, blob := range blobs {
+		select {
+		case ch <- blob:
+		case err := <-errs:
+			close(ch)
+			for range errs {
+			}
+			return err
+		}
+	}
+	close(ch)
+	return <-errs
+}
+
+func writeAndStream(t *testing.T, outFile string, opts WriterOptions) {
+	want := testBlobs(30)
+	var wantSummaries []Summary
+	for _, blob := range want[1:] {
+		wantSummaries = append(wantSummaries, Summarize(blob.PrimitiveBlock))
+	}
+	if err := writeTestBlobs(outFile, opts, want); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ret := make(chan DecodedBlob)
+	go StreamBlobs(outFile, ReaderOptions{}, ret)
+	var i int
+	for blob := range ret {
+		if blob.Err != nil {
+			t.Error(blob.Err)
+			return
+		} else if blob.Index != i {
+			t.Errorf("got index %d, want %d", blob.Index, i)
+		} else if i == 0 && blob.HeaderBlock == nil {
+			t.Errorf("first blob is not a HeaderBlock")
+		} else if i > 0 && Summarize(blob.PrimitiveBlock) != wantSummaries[i-1] {
+			t.Errorf("blob %d differs after round trip", i)
+		} else if i > 0 && blob.Compression != opts.Compression {
+			t.Errorf("got compression %s, want %s", blob.Compression, opts.Compression)
+		}
+		i++
+	}
+	if i != len(want) {
+		t.Errorf("got %d blobs, want %d", i, len(want))
+	}
+}
+
+func TestConcurrentRoundTrips(t *testing.T) {
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	for i, compression := range []string{"raw", "zlib", "zstd", "zlib", "zstd"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			outFile := filepath.Join(dir, fmt.Sprintf("%d.osm.pbf", i))
+			writeAndStream(t, outFile, WriterOptions{Compression: compression})
+		}()
+	}
+	wg.Wait()
+}
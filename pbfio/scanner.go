@@ -0,0 +1,176 @@
+package pbfio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/codesoap/pbf-reblob/pbfproto"
+)
+
+// BlobInfo describes a blob, without its data having been decompressed.
+type BlobInfo struct {
+	Index      int   // Sequential index of the blob.
+	Offset     int64 // File offset of the length prefix of the BlobHeader.
+	HeaderSize int   // Size of the marshalled BlobHeader.
+	DataSize   int   // Size of the marshalled Blob.
+	BlobHeader *pbfproto.BlobHeader
+
+	// Compression is "raw", "zlib", "lzma", "bzip2", "lz4" or "zstd".
+	Compression string
+
+	// RawSize is the uncompressed size of the data. It is zero if the
+	// Blob does not specify it.
+	RawSize int
+}
+
+// BlobScanner reads only the framing of a PBF file and the few bytes
+// needed to determine the compression and raw size of each blob. If the
+// underlying reader is an io.Seeker, the compressed data is skipped by
+// seeking, which makes scanning even huge files fast.
+type BlobScanner struct {
+	r          io.Reader
+	index      int
+	offset     int64
+	prevOffset int64
+}
+
+// NewBlobScanner creates a BlobScanner which reads from r. r must be
+// positioned at the start of a BlobHeader's length prefix, usually the
+// start of a file.
+func NewBlobScanner(r io.Reader) *BlobScanner {
+	return &BlobScanner{r: r}
+}
+
+// Next returns information about the next blob. If there are no more
+// blobs, io.EOF is returned.
+func (s *BlobScanner) Next() (BlobInfo, error) {
+	info := BlobInfo{Index: s.index, Offset: s.offset}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(s.r, buf); err == io.EOF {
+		return info, s.checkEnd()
+	} else if err != nil {
+		return info, fmt.Errorf("%s: could not read blob header size: %v", position(s.index, s.offset), err)
+	}
+	headerSize := binary.BigEndian.Uint32(buf)
+	if headerSize >= maxBlobHeaderSize {
+		return info, fmt.Errorf("%s: blobHeader size %d >= 64KiB", position(s.index, s.offset), headerSize)
+	}
+	buf = make([]byte, headerSize)
+	if _, err := io.ReadFull(s.r, buf); err != nil {
+		return info, fmt.Errorf("%s: could not read BlobHeader: %v", position(s.index, s.offset), noEOF(err))
+	}
+	info.HeaderSize = int(headerSize)
+	info.BlobHeader = &pbfproto.BlobHeader{}
+	if err := info.BlobHeader.UnmarshalVT(buf); err != nil {
+		return info, fmt.Errorf("%s: could not unmarshal BlobHeader: %v", position(s.index, s.offset), err)
+	} else if info.BlobHeader.Type == nil {
+		return info, fmt.Errorf("%s: fileblock is missing type", position(s.index, s.offset))
+	} else if datasize := info.BlobHeader.GetDatasize(); datasize <= 0 || datasize > maxDatasize {
+		return info, fmt.Errorf("%s: invalid datasize %d", position(s.index, s.offset), datasize)
+	}
+	info.DataSize = int(info.BlobHeader.GetDatasize())
+	if err := s.scanBlob(&info); err != nil {
+		return info, fmt.Errorf("%s: could not scan blob: %v", position(s.index, s.offset), err)
+	}
+	s.index++
+	s.prevOffset = s.offset
+	s.offset += 4 + int64(info.HeaderSize) + int64(info.DataSize)
+	return info, nil
+}
+
+// scanBlob reads the fields of a marshalled Blob, but skips over the
+// contents of the data field.
+func (s *BlobScanner) scanBlob(info *BlobInfo) error {
+	r := &countingByteReader{r: s.r}
+	for r.n < int64(info.DataSize) {
+		tag, err := binary.ReadUvarint(r)
+		if err != nil {
+			return noEOF(err)
+		}
+		field, wireType := tag>>3, tag&7
+		switch wireType {
+		case 0: // varint
+			v, err := binary.ReadUvarint(r)
+			if err != nil {
+				return noEOF(err)
+			} else if field == 2 {
+				info.RawSize = int(v)
+			}
+		case 2: // length-delimited
+			l, err := binary.ReadUvarint(r)
+			if err != nil {
+				return noEOF(err)
+			} else if l > uint64(int64(info.DataSize)-r.n) {
+				return fmt.Errorf("field %d exceeds blob", field)
+			}
+			switch field {
+			case 1:
+				info.Compression = "raw"
+				if info.RawSize == 0 {
+					info.RawSize = int(l)
+				}
+			case 3:
+				info.Compression = "zlib"
+			case 4:
+				info.Compression = "lzma"
+			case 5:
+				info.Compression = "bzip2"
+			case 6:
+				info.Compression = "lz4"
+			case 7:
+				info.Compression = "zstd"
+			}
+			if err = s.skip(int64(l)); err != nil {
+				return err
+			}
+			r.n += int64(l)
+		default:
+			return fmt.Errorf("unexpected wire type %d", wireType)
+		}
+	}
+	if r.n != int64(info.DataSize) {
+		return fmt.Errorf("blob fields exceed datasize")
+	}
+	return nil
+}
+
+func (s *BlobScanner) skip(n int64) error {
+	if seeker, ok := s.r.(io.Seeker); ok {
+		_, err := seeker.Seek(n, io.SeekCurrent)
+		return err
+	}
+	_, err := io.CopyN(io.Discard, s.r, n)
+	return noEOF(err)
+}
+
+// checkEnd returns io.EOF if the previous blob was complete. Skipping
+// data by seeking does not detect truncated files, so the file size is
+// checked here.
+func (s *BlobScanner) checkEnd() error {
+	if seeker, ok := s.r.(io.Seeker); ok {
+		end, err := seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		} else if end < s.offset {
+			return fmt.Errorf("%s: blob is truncated", position(s.index-1, s.prevOffset))
+		}
+	}
+	return io.EOF
+}
+
+// countingByteReader reads single bytes from r and counts them. It
+// does not buffer, so that r can be used directly afterwards.
+type countingByteReader struct {
+	r   io.Reader
+	n   int64
+	buf [1]byte
+}
+
+func (r *countingByteReader) ReadByte() (byte, error) {
+	if _, err := io.ReadFull(r.r, r.buf[:]); err != nil {
+		return 0, err
+	}
+	r.n++
+	return r.buf[0], nil
+}
@@ -0,0 +1,81 @@
+package pbfio
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBlobScanner(t *testing.T) {
+	dir := t.TempDir()
+	for _, compression := range []string{"raw", "zlib", "zstd"} {
+		inFile := filepath.Join(dir, compression+".osm.pbf")
+		if err := writeTestBlobs(inFile, WriterOptions{Compression: compression}, testBlobs(20)); err != nil {
+			t.Fatal(err)
+		}
+		var want []DecodedBlob
+		blobs := make(chan DecodedBlob)
+		go StreamBlobs(inFile, ReaderOptions{}, blobs)
+		for blob := range blobs {
+			if blob.Err != nil {
+				t.Fatal(blob.Err)
+			}
+			want = append(want, blob)
+		}
+		data, err := os.ReadFile(inFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		file, err := os.Open(inFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		// Without Seek, the data must be skipped by reading it.
+		unseekable := struct{ io.Reader }{bytes.NewReader(data)}
+		for name, r := range map[string]io.Reader{"seekable": file, "unseekable": unseekable} {
+			scanner := NewBlobScanner(r)
+			var i int
+			var end int64
+			for ; ; i++ {
+				info, err := scanner.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatalf("%s %s: %v", compression, name, err)
+				} else if i >= len(want) {
+					t.Fatalf("%s %s: found more than %d blobs", compression, name, len(want))
+				}
+				w := want[i]
+				if info.Index != w.Index || info.Offset != w.Offset || info.HeaderSize != w.HeaderSize ||
+					info.DataSize != w.DataSize || info.RawSize != w.RawSize ||
+					info.BlobHeader.GetType() != w.BlobHeader.GetType() {
+					t.Errorf("%s %s: got %+v for %s", compression, name, info, w.Position())
+				}
+				if w.Index > 0 && info.Compression != compression {
+					t.Errorf("%s %s: got compression %s for %s", compression, name, info.Compression, w.Position())
+				}
+				end = info.Offset + 4 + int64(info.HeaderSize) + int64(info.DataSize)
+			}
+			if i != len(want) || end != int64(len(data)) {
+				t.Errorf("%s %s: got %d blobs ending at %d; want %d ending at %d", compression, name, i, end, len(want), len(data))
+			}
+		}
+
+		truncated := bytes.NewReader(data[:len(data)-1])
+		for name, r := range map[string]io.Reader{"seekable": truncated, "unseekable": struct{ io.Reader }{truncated}} {
+			truncated.Seek(0, io.SeekStart)
+			scanner := NewBlobScanner(r)
+			var err error
+			for err == nil {
+				_, err = scanner.Next()
+			}
+			if err == io.EOF {
+				t.Errorf("%s %s: truncated file was scanned without error", compression, name)
+			}
+		}
+	}
+}
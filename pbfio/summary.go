@@ -0,0 +1,155 @@
+package pbfio
+
+import (
+	"bytes"
+
+	"github.com/codesoap/pbf-reblob/pbfproto"
+)
+
+// indexDataPrefix marks indexdata written by AppendIndexData. Other
+// programs may store different data in this field.
+var indexDataPrefix = []byte("RBIX1")
+
+// IDRange describes the IDs of all entities of one type within a block.
+// Min and Max are only meaningful if Count is greater than zero.
+type IDRange struct {
+	Count    int
+	Min, Max int64
+}
+
+func (r *IDRange) add(id int64) {
+	if r.Count == 0 || id < r.Min {
+		r.Min = id
+	}
+	if r.Count == 0 || id > r.Max {
+		r.Max = id
+	}
+	r.Count++
+}
+
+// BBox is a bounding box. Like HeaderBBox, its units are nanodegrees.
+type BBox struct {
+	Left, Right, Top, Bottom int64
+}
+
+func (b *BBox) extend(lat, lon int64, first bool) {
+	if first || lon < b.Left {
+		b.Left = lon
+	}
+	if first || lon > b.Right {
+		b.Right = lon
+	}
+	if first || lat > b.Top {
+		b.Top = lat
+	}
+	if first || lat < b.Bottom {
+		b.Bottom = lat
+	}
+}
+
+// Summary describes the contents of a PrimitiveBlock.
+type Summary struct {
+	Nodes, Ways, Relations IDRange
+
+	// BBox contains all nodes of the block. It is only meaningful if
+	// Nodes.Count is greater than zero.
+	BBox BBox
+}
+
+// Summarize collects the entity types, ID ranges and the bounding box
+// of the nodes in block.
+func Summarize(block *pbfproto.PrimitiveBlock) Summary {
+	var s Summary
+	granularity := int64(block.GetGranularity())
+	latOffset, lonOffset := block.GetLatOffset(), block.GetLonOffset()
+	addNode := func(id, lat, lon int64) {
+		lat = latOffset + granularity*lat
+		lon = lonOffset + granularity*lon
+		s.BBox.extend(lat, lon, s.Nodes.Count == 0)
+		s.Nodes.add(id)
+	}
+	for _, group := range block.Primitivegroup {
+		for _, node := range group.Nodes {
+			addNode(node.GetId(), node.GetLat(), node.GetLon())
+		}
+		if group.Dense != nil {
+			var id, lat, lon int64
+			dense := group.Dense
+			for i := 0; i < min(len(dense.Id), len(dense.Lat), len(dense.Lon)); i++ {
+				id += dense.Id[i]
+				lat += dense.Lat[i]
+				lon += dense.Lon[i]
+				addNode(id, lat, lon)
+			}
+		}
+		for _, way := range group.Ways {
+			s.Ways.add(way.GetId())
+		}
+		for _, rel := range group.Relations {
+			s.Relations.add(rel.GetId())
+		}
+	}
+	return s
+}
+
+// Extent returns the bounding box of all locations in block. These are
+// the locations of nodes and the node locations stored in ways. If block
+// contains no locations, ok is false.
+func Extent(block *pbfproto.PrimitiveBlock) (b BBox, ok bool) {
+	granularity := int64(block.GetGranularity())
+	latOffset, lonOffset := block.GetLatOffset(), block.GetLonOffset()
+	add := func(lat, lon int64) {
+		b.extend(latOffset+granularity*lat, lonOffset+granularity*lon, !ok)
+		ok = true
+	}
+	for _, group := range block.Primitivegroup {
+		for _, node := range group.Nodes {
+			add(node.GetLat(), node.GetLon())
+		}
+		if dense := group.Dense; dense != nil {
+			var lat, lon int64
+			for i := 0; i < min(len(dense.Lat), len(dense.Lon)); i++ {
+				lat += dense.Lat[i]
+				lon += dense.Lon[i]
+				add(lat, lon)
+			}
+		}
+		for _, way := range group.Ways {
+			var lat, lon int64
+			for i := 0; i < min(len(way.Lat), len(way.Lon)); i++ {
+				lat += way.Lat[i]
+				lon += way.Lon[i]
+				add(lat, lon)
+			}
+		}
+	}
+	return b, ok
+}
+
+// Union returns the smallest bounding box containing b and o.
+func (b BBox) Union(o BBox) BBox {
+	return BBox{
+		Left:   min(b.Left, o.Left),
+		Right:  max(b.Right, o.Right),
+		Top:    max(b.Top, o.Top),
+		Bottom: min(b.Bottom, o.Bottom),
+	}
+}
+
+// AppendIndexData appends the encoding of s for the indexdata field of
+// a BlobHeader to buf.
+func (s Summary) AppendIndexData(buf []byte) []byte {
+	buf = append(buf, indexDataPrefix...)
+	return s.appendBinary(buf)
+}
+
+// ParseIndexData decodes indexdata, that was written by
+// AppendIndexData. If indexdata has a different origin, ok is false.
+func ParseIndexData(indexdata []byte) (s Summary, ok bool) {
+	if !bytes.HasPrefix(indexdata, indexDataPrefix) {
+		return s, false
+	}
+	r := bytes.NewReader(indexdata[len(indexDataPrefix):])
+	s, err := readSummary(r)
+	return s, err == nil && r.Len() == 0
+}
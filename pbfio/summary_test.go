@@ -0,0 +1,59 @@
+package pbfio
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestIndexDataRoundTrip(t *testing.T) {
+	summaries := []Summary{
+		{},
+		{Nodes: IDRange{Count: 3, Min: -5, Max: 1 << 40}, BBox: BBox{Left: -180e9, Right: 180e9, Top: 90e9, Bottom: -90e9}},
+		{Ways: IDRange{Count: 1, Min: 7, Max: 7}, Relations: IDRange{Count: 2, Min: -2, Max: -1}},
+	}
+	for _, want := range summaries {
+		indexdata := want.AppendIndexData([]byte("ignored"))[len("ignored"):]
+		if got, ok := ParseIndexData(indexdata); !ok || got != want {
+			t.Errorf("got %+v, %t after round trip; want %+v", got, ok, want)
+		}
+		if _, ok := ParseIndexData(indexdata[:len(indexdata)-1]); ok {
+			t.Errorf("truncated indexdata of %+v was parsed", want)
+		}
+		if _, ok := ParseIndexData(append(indexdata, 0)); ok {
+			t.Errorf("indexdata of %+v with trailing data was parsed", want)
+		}
+	}
+	if _, ok := ParseIndexData([]byte("foreign indexdata")); ok {
+		t.Errorf("foreign indexdata was parsed")
+	}
+}
+
+func TestWriteIndexData(t *testing.T) {
+	outFile := filepath.Join(t.TempDir(), "out.osm.pbf")
+	if err := writeTestBlobs(outFile, WriterOptions{Compression: "zlib", IndexData: true}, testBlobs(10)); err != nil {
+		t.Fatal(err)
+	}
+	// Only the blob containing node 12 is read.
+	var filtered int
+	opts := ReaderOptions{Filter: func(s Summary) bool {
+		filtered++
+		return s.Nodes.Min <= 12 && s.Nodes.Max >= 12
+	}}
+	blobs := make(chan DecodedBlob)
+	go StreamBlobs(outFile, opts, blobs)
+	var read int
+	for blob := range blobs {
+		if blob.Err != nil {
+			t.Fatal(blob.Err)
+		} else if blob.PrimitiveBlock == nil {
+			continue
+		}
+		read++
+		if s, ok := blob.IndexData(); !ok || s != Summarize(blob.PrimitiveBlock) {
+			t.Errorf("%s has indexdata %+v, %t; want %+v", blob.Position(), s, ok, Summarize(blob.PrimitiveBlock))
+		}
+	}
+	if filtered != 10 || read != 1 {
+		t.Errorf("filtered %d blobs and read %d; want 10 and 1", filtered, read)
+	}
+}
@@ -1,34 +1,41 @@
 package pbfio
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
 	"os"
 	"runtime"
-	"sync"
 
 	"github.com/codesoap/lineworker"
-	"github.com/codesoap/pbf-reblob/pbfproto"
-	"github.com/klauspost/compress/zlib"
-	"github.com/klauspost/compress/zstd"
 )
 
-var zlibWriterPool []*zlib.Writer
-var zlibWriterPoolLock sync.Mutex
-var zstdEncoder *zstd.Encoder
-var zstdEncoderLock sync.Mutex
+// WriterOptions modify the behaviour of WriteBlobs.
+type WriterOptions struct {
+	// Compression is either "raw", "zlib" or "zstd".
+	Compression string
+
+	// IndexData enables storing the Summary of each PrimitiveBlock in
+	// the indexdata field of its BlobHeader. Otherwise indexdata is
+	// cleared for PrimitiveBlocks, because the contents of the blob may
+	// have changed.
+	IndexData bool
+
+	// PassThrough enables writing the DecodedBlob.RawBlob of blobs that
+	// already use the requested compression, instead of marshalling
+	// and compressing them again.
+	PassThrough bool
+}
 
 // WriteBlobs writes received blobs to outFile after serializing them.
 // Any errors are written to the errs channel; this channel will be
 // closed before the function returns.
-//
-// This function is not safe for concurrent use.
-func WriteBlobs(outFile string, compression string, blobs chan DecodedBlob, errs chan error) {
+func WriteBlobs(outFile string, opts WriterOptions, blobs chan DecodedBlob, errs chan error) {
 	defer close(errs)
+	compressor := newCompressor()
+	defer compressor.close()
 	blobbers := lineworker.NewWorkerPool(runtime.NumCPU(),
 		func(blob DecodedBlob) (*undecodedBlob, error) {
-			return serializeBlob(compression, blob)
+			return serializeBlob(compressor, opts, blob)
 		})
 
 	go feedBlobsToSerializer(blobs, blobbers)
@@ -56,12 +63,6 @@ func WriteBlobs(outFile string, compression string, blobs chan DecodedBlob, errs
 			break
 		}
 	}
-
-	zlibWriterPoolLock.Lock()
-	for _, writer := range zlibWriterPool {
-		writer.Close()
-	}
-	zlibWriterPoolLock.Unlock()
 }
 
 func feedBlobsToSerializer(blobs chan DecodedBlob, blobbers *lineworker.WorkerPool[DecodedBlob, *undecodedBlob]) {
@@ -75,7 +76,10 @@ func feedBlobsToSerializer(blobs chan DecodedBlob, blobbers *lineworker.WorkerPo
 	blobbers.Stop()
 }
 
-func serializeBlob(compression string, blob DecodedBlob) (*undecodedBlob, error) {
+func serializeBlob(compressor *compressor, opts WriterOptions, blob DecodedBlob) (*undecodedBlob, error) {
+	if opts.PassThrough && blob.RawBlob != nil && blob.Compression == opts.Compression {
+		return passThroughBlob(opts, blob), nil
+	}
 	var err error
 	var data []byte
 	if blob.HeaderBlock != nil {
@@ -84,6 +88,11 @@ func serializeBlob(compression string, blob DecodedBlob) (*undecodedBlob, error)
 		if blob.PrimitiveBlock == nil {
 			return nil, fmt.Errorf("cannot write unknown blob type")
 		}
+		blob.BlobHeader.Indexdata = nil
+		if opts.IndexData {
+			summary := Summarize(blob.PrimitiveBlock)
+			blob.BlobHeader.Indexdata = summary.AppendIndexData(nil)
+		}
 		data = rawBlobPool.Get().([]byte)
 		size := blob.PrimitiveBlock.SizeVT()
 		if cap(data) < size {
@@ -96,7 +105,7 @@ func serializeBlob(compression string, blob DecodedBlob) (*undecodedBlob, error)
 	if err != nil {
 		return nil, fmt.Errorf("could not encode blob data: %v", err)
 	}
-	rawBlob, err := toRawBlob(compression, data)
+	rawBlob, err := compressor.toRawBlob(opts.Compression, data)
 	rawBlobPool.Put(data)
 	if err != nil {
 		return nil, err
@@ -106,6 +115,21 @@ func serializeBlob(compression string, blob DecodedBlob) (*undecodedBlob, error)
 	return &undecodedBlob{blobHeader: blob.BlobHeader, blob: rawBlob}, err
 }
 
+// passThroughBlob prepares blob to be written without changing its
+// data. Its indexdata is only replaced if opts.IndexData is set.
+func passThroughBlob(opts WriterOptions, blob DecodedBlob) *undecodedBlob {
+	if blob.PrimitiveBlock != nil {
+		if opts.IndexData {
+			summary := Summarize(blob.PrimitiveBlock)
+			blob.BlobHeader.Indexdata = summary.AppendIndexData(nil)
+		}
+		blob.PrimitiveBlock.ReturnToVTPool()
+	}
+	rawBlobSize := int32(len(blob.RawBlob))
+	blob.BlobHeader.Datasize = &rawBlobSize
+	return &undecodedBlob{blobHeader: blob.BlobHeader, blob: blob.RawBlob}
+}
+
 func (b *undecodedBlob) write(file *os.File) error {
 	defer rawBlobPool.Put(b.blob)
 	rawHeader, err := b.blobHeader.MarshalVT()
@@ -123,68 +147,3 @@ func (b *undecodedBlob) write(file *os.File) error {
 	_, err = file.Write(b.blob)
 	return err
 }
-
-func toRawBlob(compression string, data []byte) ([]byte, error) {
-	switch compression {
-	case "raw":
-		blob := &pbfproto.Blob{Data: &pbfproto.Blob_Raw{Raw: data}}
-		return blob.MarshalVT()
-	case "zlib":
-		return toRawZlibBlob(data)
-	case "zstd":
-		return toRawZstdBlob(data)
-	}
-	return nil, fmt.Errorf("invalid compression '%s'", compression)
-}
-
-func toRawZlibBlob(data []byte) ([]byte, error) {
-	b := rawBlobPool.Get().([]byte)[:0]
-	buf := bytes.NewBuffer(b)
-	var zlibWriter *zlib.Writer
-	zlibWriterPoolLock.Lock()
-	if len(zlibWriterPool) > 0 {
-		zlibWriter = zlibWriterPool[len(zlibWriterPool)-1]
-		zlibWriter.Reset(buf)
-		zlibWriterPool = zlibWriterPool[:len(zlibWriterPool)-1]
-	} else {
-		zlibWriter, _ = zlib.NewWriterLevel(buf, zlib.BestCompression)
-	}
-	zlibWriterPoolLock.Unlock()
-	defer func() {
-		zlibWriterPoolLock.Lock()
-		zlibWriterPool = append(zlibWriterPool, zlibWriter)
-		zlibWriterPoolLock.Unlock()
-	}()
-	if _, err := zlibWriter.Write(data); err != nil {
-		return nil, err
-	}
-	if err := zlibWriter.Flush(); err != nil {
-		return nil, err
-	}
-	rawSize := int32(len(data))
-	blob := &pbfproto.Blob{
-		RawSize: &rawSize,
-		Data:    &pbfproto.Blob_ZlibData{ZlibData: buf.Bytes()},
-	}
-	return blob.MarshalVT()
-}
-
-func toRawZstdBlob(data []byte) ([]byte, error) {
-	var err error
-	zstdEncoderLock.Lock()
-	if zstdEncoder == nil {
-		zstdEncoder, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
-	}
-	zstdEncoderLock.Unlock()
-	if err != nil {
-		return nil, err
-	}
-	out := rawBlobPool.Get().([]byte)[:0]
-	out = zstdEncoder.EncodeAll(data, out)
-	rawSize := int32(len(out))
-	blob := &pbfproto.Blob{
-		RawSize: &rawSize,
-		Data:    &pbfproto.Blob_ZstdData{ZstdData: out},
-	}
-	return blob.MarshalVT()
-}
@@ -0,0 +1,126 @@
+package pbfio
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/codesoap/pbf-reblob/pbfproto"
+)
+
+func TestZstdRawSize(t *testing.T) {
+	outFile := filepath.Join(t.TempDir(), "zstd.osm.pbf")
+	dataType := "OSMData"
+	dense := &pbfproto.DenseNodes{}
+	for i := 0; i < 1000; i++ {
+		dense.Id = append(dense.Id, 1)
+		dense.Lat = append(dense.Lat, 1)
+		dense.Lon = append(dense.Lon, 1)
+	}
+	block := &pbfproto.PrimitiveBlock{
+		Stringtable:    &pbfproto.StringTable{S: [][]byte{{}}},
+		Primitivegroup: []*pbfproto.PrimitiveGroup{{Dense: dense}},
+	}
+	wantRawSize := int32(block.SizeVT())
+	blobs := make(chan DecodedBlob)
+	errs := make(chan error)
+	go WriteBlobs(outFile, WriterOptions{Compression: "zstd"}, blobs, errs)
+	blobs <- DecodedBlob{BlobHeader: &pbfproto.BlobHeader{Type: &dataType}, PrimitiveBlock: block}
+	close(blobs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(outFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headerSize := binary.BigEndian.Uint32(data)
+	header := &pbfproto.BlobHeader{}
+	if err = header.UnmarshalVT(data[4 : 4+headerSize]); err != nil {
+		t.Fatal(err)
+	}
+	blob := &pbfproto.Blob{}
+	if err = blob.UnmarshalVT(data[4+headerSize:][:header.GetDatasize()]); err != nil {
+		t.Fatal(err)
+	}
+	if blob.GetRawSize() != wantRawSize {
+		t.Errorf("got raw size %d, want %d", blob.GetRawSize(), wantRawSize)
+	}
+}
+
+func TestPassThrough(t *testing.T) {
+	dir := t.TempDir()
+	inFile, outFile := filepath.Join(dir, "in.osm.pbf"), filepath.Join(dir, "out.osm.pbf")
+	// The input is compressed with a different level than WriteBlobs
+	// uses, so that recompressed blobs would differ from it.
+	input := testBlobs(10)
+	for i := range input[1:] {
+		blob := &input[i+1]
+		data, err := blob.PrimitiveBlock.MarshalVT()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		w, _ := zlib.NewWriterLevel(&buf, zlib.BestSpeed)
+		w.Write(data)
+		w.Close()
+		rawSize := int32(len(data))
+		raw := &pbfproto.Blob{RawSize: &rawSize, Data: &pbfproto.Blob_ZlibData{ZlibData: buf.Bytes()}}
+		if blob.RawBlob, err = raw.MarshalVT(); err != nil {
+			t.Fatal(err)
+		}
+		blob.Compression = "zlib"
+	}
+	if err := writeTestBlobs(inFile, WriterOptions{Compression: "zlib", PassThrough: true}, input); err != nil {
+		t.Fatal(err)
+	}
+	var blobs []DecodedBlob
+	ch := make(chan DecodedBlob)
+	go StreamBlobs(inFile, ReaderOptions{KeepRaw: true}, ch)
+	for blob := range ch {
+		if blob.Err != nil {
+			t.Fatal(blob.Err)
+		}
+		blobs = append(blobs, blob)
+	}
+	// Blob 5 is modified, so it must be written again.
+	blobs[5].PrimitiveBlock.Stringtable.S[1] = []byte("changed")
+	blobs[5].RawBlob = nil
+	if err := writeTestBlobs(outFile, WriterOptions{Compression: "zlib", PassThrough: true}, blobs); err != nil {
+		t.Fatal(err)
+	}
+
+	in, err := os.ReadFile(inFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.ReadFile(outFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := func(data []byte, blob DecodedBlob) []byte {
+		return data[blob.Offset : blob.Offset+4+int64(blob.HeaderSize)+int64(blob.DataSize)]
+	}
+	ch = make(chan DecodedBlob)
+	go StreamBlobs(outFile, ReaderOptions{}, ch)
+	var i int
+	for blob := range ch {
+		if blob.Err != nil {
+			t.Fatal(blob.Err)
+		} else if i == 5 {
+			if got := string(blob.PrimitiveBlock.Stringtable.S[1]); got != "changed" {
+				t.Errorf("modified blob has string %q", got)
+			}
+		} else if !bytes.Equal(frame(out, blob), frame(in, blobs[i])) {
+			t.Errorf("%s differs from the input", blob.Position())
+		}
+		i++
+	}
+	if i != len(blobs) {
+		t.Errorf("got %d blobs, want %d", i, len(blobs))
+	}
+}
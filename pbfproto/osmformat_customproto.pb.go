@@ -2,22 +2,24 @@ package pbfproto
 
 import "github.com/planetscale/vtprotobuf/protohelpers"
 
-var groupSizes []int
+// GroupSizeCache holds the sizes of the groups of a PrimitiveBlock,
+// that have previously been calculated by MySize.
+type GroupSizeCache []int
 
-func (m *PrimitiveBlock) ClearGroupSizeCache() {
-	groupSizes = nil
+// Clear must be called before the cache is used for a new
+// PrimitiveBlock.
+func (c *GroupSizeCache) Clear() {
+	*c = (*c)[:0]
 }
 
 // MySize is a custom size caculation function based on the one from
 // vtprotobuf. It is improved by using a cache for previously calculated
 // group sizes.
 //
-// Before using it on a new PrimitiveBlock, ClearGroupSizeCache must be
-// called.
-//
-// It may only be used for a single PrimitiveBlock at a time, because it
-// uses a global cache.
-func (m *PrimitiveBlock) MySize() (n int) {
+// A cache may only be used for a single PrimitiveBlock at a time and
+// groups must only be appended to the PrimitiveBlock, while the cache
+// is in use.
+func (m *PrimitiveBlock) MySize(cache *GroupSizeCache) (n int) {
 	if m == nil {
 		return 0
 	}
@@ -30,11 +32,11 @@ func (m *PrimitiveBlock) MySize() (n int) {
 	if len(m.Primitivegroup) > 0 {
 		for i, e := range m.Primitivegroup {
 			var l int
-			if i < len(groupSizes) {
-				l = (groupSizes)[i]
+			if i < len(*cache) {
+				l = (*cache)[i]
 			} else {
 				l = e.SizeVT()
-				groupSizes = append(groupSizes, l)
+				*cache = append(*cache, l)
 			}
 			n += 1 + l + protohelpers.SizeOfVarint(uint64(l))
 		}
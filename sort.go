@@ -0,0 +1,460 @@
+package main
+
+import (
+	"cmp"
+	"container/heap"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/codesoap/pbf-reblob/pbfio"
+	"github.com/codesoap/pbf-reblob/pbfproto"
+)
+
+// sortBlobs sorts the entities of the blobs from blobsIn by type, then
+// ID, and passes them on in blobs of up to cfg.maxBlobSize. If
+// cfg.cluster is set, entities of the same type are clustered by their
+// location instead. If the entities need more than cfg.sortMemory,
+// sorted runs are written to temporary files next to cfg.outFile, which
+// are merged afterwards, without exceeding cfg.sortMemory. If locations
+// is not nil, node locations are added to the sorted ways.
+func sortBlobs(cfg config, blobsIn chan pbfio.DecodedBlob, blobsOut chan pbfio.DecodedBlob, errs chan error, stats *outputStats, locations *locationAdder) error {
+	sortKey := func(e *pbfio.Entity) uint64 { return 0 }
+	if cfg.cluster != "" {
+		ways := cfg.cluster == "ways"
+		sortKey = func(e *pbfio.Entity) uint64 { return clusterCell(e, ways) }
+	}
+	// Ways can only be clustered by their location, if it is known
+	// before sorting.
+	earlyLocations := locations != nil && cfg.cluster == "ways"
+	var tmpDir string
+	var runs []run
+	defer func() {
+		if tmpDir != "" {
+			os.RemoveAll(tmpDir)
+		}
+	}()
+	builder := pbfio.BlockBuilder{Granularity: 100, DateGranularity: 1000}
+	changesetsDropped := false
+	var entities []sortEntity
+	var memory int
+	writeEntities := func() error {
+		if tmpDir == "" {
+			var err error
+			if tmpDir, err = os.MkdirTemp(filepath.Dir(cfg.outFile), ".pbf-reblob-sort-"); err != nil {
+				return fmt.Errorf("could not create directory for sorted runs: %v", err)
+			}
+		}
+		slices.SortStableFunc(entities, compareSortEntities)
+		r, err := writeRun(filepath.Join(tmpDir, fmt.Sprint(len(runs))), builder, func(add func(*pbfio.Entity) error) error {
+			for i := range entities {
+				if err := add(&entities[i].entity); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("could not write sorted run: %v", err)
+		} else if cfg.verbose {
+			log.Printf("Info: Wrote sorted run %d with %d entities", len(runs), len(entities))
+		}
+		runs = append(runs, r)
+		clear(entities)
+		entities, memory = entities[:0], 0
+		return nil
+	}
+	for blob := range blobsIn {
+		if blob.Err != nil {
+			return fmt.Errorf("could not read blob: %v", blob.Err)
+		} else if *blob.BlobHeader.Type != "OSMData" {
+			return fmt.Errorf("%s: unexpected blob type '%s'",
+				blob.Position(), *blob.BlobHeader.Type)
+		} else if err := checkWayLocations(blob.PrimitiveBlock, cfg.locationsOnWays); err != nil {
+			return fmt.Errorf("%s: %v", blob.Position(), err)
+		}
+		// Use the finest units of all blocks, so that no location or
+		// timestamp is rounded.
+		block := blob.PrimitiveBlock
+		builder.Granularity = int32(gcd(int64(builder.Granularity),
+			gcd(int64(block.GetGranularity()), gcd(block.GetLatOffset(), block.GetLonOffset()))))
+		builder.DateGranularity = int32(gcd(int64(builder.DateGranularity), int64(block.GetDateGranularity())))
+		if !changesetsDropped && blockKinds(block)&kindChangesets != 0 {
+			fmt.Fprintf(os.Stderr, "Warning: %s contains changesets, which are dropped when sorting.\n", blob.Position())
+			changesetsDropped = true
+		}
+		blobEntities, err := pbfio.Entities(blob.PrimitiveBlock)
+		blob.PrimitiveBlock.ReturnToVTPool()
+		if err != nil {
+			return fmt.Errorf("%s: %v", blob.Position(), err)
+		}
+		for i := range blobEntities {
+			e := &blobEntities[i]
+			if earlyLocations {
+				if err = locations.addToEntity(e); err != nil {
+					return err
+				}
+			}
+			memory += entityMemSize(e)
+			entities = append(entities, sortEntity{key: sortKey(e), entity: *e})
+		}
+		if memory >= cfg.sortMemory {
+			if err = writeEntities(); err != nil {
+				return err
+			}
+		}
+	}
+
+	var sources []entitySource
+	if len(runs) == 0 {
+		slices.SortStableFunc(entities, compareSortEntities)
+		sources = append(sources, &sliceSource{entities: entities})
+	} else {
+		// Only one block of every run is held in memory while merging.
+		if len(entities) > 0 {
+			if err := writeEntities(); err != nil {
+				return err
+			}
+		}
+		var err error
+		if runs, err = reduceRuns(cfg, runs, builder, sortKey); err != nil {
+			return err
+		}
+		for _, r := range runs {
+			source, err := openRunSource(r.file, sortKey)
+			if err != nil {
+				return fmt.Errorf("could not open sorted run: %v", err)
+			}
+			defer source.close()
+			sources = append(sources, source)
+		}
+	}
+
+	emit := func() error {
+		block := builder.Build()
+		blob := pbfio.DecodedBlob{
+			BlobHeader:     &pbfproto.BlobHeader{Type: ptr("OSMData")},
+			PrimitiveBlock: block,
+			RawSize:        block.SizeVT(),
+		}
+		return sendBlob(cfg, blob, blobsOut, errs, stats)
+	}
+	var prevType pbfio.EntityType
+	err := mergeSources(sources, func(e *pbfio.Entity) error {
+		if locations != nil && !earlyLocations {
+			if err := locations.addToEntity(e); err != nil {
+				return err
+			}
+		}
+		if builder.Len() > 0 && (cfg.sameKind && e.Type != prevType || !builder.Fits(e, cfg.maxBlobSize)) {
+			if err := emit(); err != nil {
+				return err
+			}
+		}
+		builder.Add(e)
+		prevType = e.Type
+		return nil
+	})
+	if err != nil || builder.Len() == 0 {
+		return err
+	}
+	return emit()
+}
+
+// runBlockSize is the uncompressed size limit of the blocks of sorted
+// runs. It is small, because one block of every run is held in memory
+// while the runs are merged.
+const runBlockSize = 1 << 20
+
+// run is a file of sorted entities.
+type run struct {
+	file string
+
+	// blockMemory is the largest estimated memory needed for the
+	// decoded entities of one block of the run.
+	blockMemory int
+}
+
+// writeRun writes the entities, that are passed to add by fill, to
+// runFile. They must already be sorted. builder determines the units of
+// the blocks.
+func writeRun(runFile string, builder pbfio.BlockBuilder, fill func(add func(*pbfio.Entity) error) error) (run, error) {
+	r := run{file: runFile}
+	blobs := make(chan pbfio.DecodedBlob)
+	errs := make(chan error)
+	go pbfio.WriteBlobs(runFile, pbfio.WriterOptions{Compression: "zstd"}, blobs, errs)
+	var memory int
+	send := func() error {
+		r.blockMemory = max(r.blockMemory, memory)
+		memory = 0
+		blob := pbfio.DecodedBlob{
+			BlobHeader:     &pbfproto.BlobHeader{Type: ptr("OSMData")},
+			PrimitiveBlock: builder.Build(),
+		}
+		select {
+		case blobs <- blob:
+			return nil
+		case err := <-errs:
+			return err
+		}
+	}
+	err := fill(func(e *pbfio.Entity) error {
+		if !builder.Fits(e, runBlockSize) {
+			if err := send(); err != nil {
+				return err
+			}
+		}
+		builder.Add(e)
+		memory += entityMemSize(e)
+		return nil
+	})
+	if err == nil && builder.Len() > 0 {
+		err = send()
+	}
+	close(blobs)
+	if err != nil {
+		for range errs {
+		}
+		return r, err
+	} else if err, ok := <-errs; ok {
+		return r, err
+	}
+	return r, nil
+}
+
+// reduceRuns merges runs into fewer runs, until reading one block of
+// each of them fits into cfg.sortMemory. Consecutive runs are merged, so
+// that equal entities keep the order of their runs.
+func reduceRuns(cfg config, runs []run, builder pbfio.BlockBuilder, sortKey func(*pbfio.Entity) uint64) ([]run, error) {
+	for pass := 0; ; pass++ {
+		var blockMemory int
+		for _, r := range runs {
+			blockMemory = max(blockMemory, r.blockMemory)
+		}
+		maxRuns := max(2, cfg.sortMemory/max(blockMemory, 1))
+		if len(runs) <= maxRuns {
+			return runs, nil
+		}
+		var merged []run
+		for i := 0; i < len(runs); i += maxRuns {
+			group := runs[i:min(i+maxRuns, len(runs))]
+			if len(group) == 1 {
+				merged = append(merged, group[0])
+				continue
+			}
+			runFile := filepath.Join(filepath.Dir(group[0].file), fmt.Sprintf("%d-%d", pass, len(merged)))
+			r, err := mergeRuns(runFile, group, builder, sortKey)
+			if err != nil {
+				return nil, fmt.Errorf("could not merge sorted runs: %v", err)
+			}
+			merged = append(merged, r)
+		}
+		if cfg.verbose {
+			log.Printf("Info: Merged %d sorted runs into %d", len(runs), len(merged))
+		}
+		runs = merged
+	}
+}
+
+// mergeRuns merges runs into the new run runFile and removes them.
+func mergeRuns(runFile string, runs []run, builder pbfio.BlockBuilder, sortKey func(*pbfio.Entity) uint64) (run, error) {
+	var sources []entitySource
+	defer func() {
+		for _, source := range sources {
+			source.(*runSource).close()
+		}
+	}()
+	for _, r := range runs {
+		source, err := openRunSource(r.file, sortKey)
+		if err != nil {
+			return run{}, err
+		}
+		sources = append(sources, source)
+	}
+	merged, err := writeRun(runFile, builder, func(add func(*pbfio.Entity) error) error {
+		return mergeSources(sources, add)
+	})
+	if err != nil {
+		return merged, err
+	}
+	for _, r := range runs {
+		os.Remove(r.file)
+	}
+	return merged, nil
+}
+
+// sortEntity is an entity with the key, that orders it among the
+// entities of its type. The key is computed once, when the entity is
+// read, instead of on every comparison.
+type sortEntity struct {
+	key    uint64
+	entity pbfio.Entity
+}
+
+// compareSortEntities orders entities by type, then key, then ID.
+func compareSortEntities(a, b sortEntity) int {
+	return cmp.Or(cmp.Compare(a.entity.Type, b.entity.Type), cmp.Compare(a.key, b.key), cmp.Compare(a.entity.ID, b.entity.ID))
+}
+
+// gcd returns the greatest common divisor of the absolute values of a
+// and b.
+func gcd(a, b int64) int64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return max(a, -a)
+}
+
+// entityMemSize estimates the memory used by e.
+func entityMemSize(e *pbfio.Entity) int {
+	n := 160
+	for _, tag := range e.Tags {
+		n += 32 + len(tag.Key) + len(tag.Value)
+	}
+	if e.Info != nil {
+		n += 64 + len(e.Info.User)
+	}
+	n += 8 * (len(e.Refs) + len(e.RefLats) + len(e.RefLons))
+	for _, member := range e.Members {
+		n += 40 + len(member.Role)
+	}
+	return n
+}
+
+// entitySource provides sorted entities. next returns nil, when there
+// are no more entities.
+type entitySource interface {
+	next() (*sortEntity, error)
+}
+
+type sliceSource struct {
+	entities []sortEntity
+}
+
+func (s *sliceSource) next() (*sortEntity, error) {
+	if len(s.entities) == 0 {
+		return nil, nil
+	}
+	e := &s.entities[0]
+	s.entities = s.entities[1:]
+	return e, nil
+}
+
+// runSource reads the entities of a file written by writeRun. Blobs are
+// read and decoded one at a time; the keys of their entities are given
+// by sortKey.
+type runSource struct {
+	file     *os.File
+	scanner  *pbfio.BlobScanner
+	reader   *pbfio.BlobReader
+	sortKey  func(*pbfio.Entity) uint64
+	entities []sortEntity
+}
+
+func openRunSource(runFile string, sortKey func(*pbfio.Entity) uint64) (*runSource, error) {
+	file, err := os.Open(runFile)
+	if err != nil {
+		return nil, err
+	}
+	return &runSource{
+		file:    file,
+		scanner: pbfio.NewBlobScanner(file),
+		reader:  pbfio.NewBlobReader(file),
+		sortKey: sortKey,
+	}, nil
+}
+
+func (s *runSource) next() (*sortEntity, error) {
+	for len(s.entities) == 0 {
+		info, err := s.scanner.Next()
+		if err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("could not read sorted run: %v", err)
+		}
+		blob, err := s.reader.ReadBlob(info.Offset)
+		if err != nil {
+			return nil, fmt.Errorf("could not read sorted run: %v", err)
+		}
+		entities, err := pbfio.Entities(blob.PrimitiveBlock)
+		blob.PrimitiveBlock.ReturnToVTPool()
+		if err != nil {
+			return nil, fmt.Errorf("could not read sorted run: blob %d at offset %d: %v", info.Index, info.Offset, err)
+		}
+		for i := range entities {
+			s.entities = append(s.entities, sortEntity{key: s.sortKey(&entities[i]), entity: entities[i]})
+		}
+	}
+	e := &s.entities[0]
+	s.entities = s.entities[1:]
+	return e, nil
+}
+
+func (s *runSource) close() {
+	s.reader.Close()
+	s.file.Close()
+}
+
+// mergeSources passes the entities of all sources to fn in the order
+// given by compareSortEntities. Entities that compare equal are passed
+// in the order of their sources.
+func mergeSources(sources []entitySource, fn func(*pbfio.Entity) error) error {
+	var h mergeHeap
+	for i, source := range sources {
+		e, err := source.next()
+		if err != nil {
+			return err
+		} else if e != nil {
+			h.items = append(h.items, mergeItem{entity: e, source: i})
+		}
+	}
+	heap.Init(&h)
+	for len(h.items) > 0 {
+		if err := fn(&h.items[0].entity.entity); err != nil {
+			return err
+		}
+		e, err := sources[h.items[0].source].next()
+		if err != nil {
+			return err
+		} else if e == nil {
+			heap.Pop(&h)
+		} else {
+			h.items[0].entity = e
+			heap.Fix(&h, 0)
+		}
+	}
+	return nil
+}
+
+type mergeItem struct {
+	entity *sortEntity
+	source int
+}
+
+type mergeHeap struct {
+	items []mergeItem
+}
+
+func (h *mergeHeap) Len() int { return len(h.items) }
+
+func (h *mergeHeap) Less(i, j int) bool {
+	c := compareSortEntities(*h.items[i].entity, *h.items[j].entity)
+	return c < 0 || c == 0 && h.items[i].source < h.items[j].source
+}
+
+func (h *mergeHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+
+func (h *mergeHeap) Push(x any) { h.items = append(h.items, x.(mergeItem)) }
+
+func (h *mergeHeap) Pop() any {
+	item := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return item
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
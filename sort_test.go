@@ -0,0 +1,123 @@
+package main
+
+import (
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/codesoap/pbf-reblob/pbfio"
+	"github.com/codesoap/pbf-reblob/pbfproto"
+)
+
+// sortTestBlobs returns blobs with shuffled entities. Every entity is
+// stored twice, with version 1 before version 2.
+func sortTestBlobs() []pbfio.DecodedBlob {
+	r := rand.New(rand.NewSource(1))
+	var entities []pbfio.Entity
+	for _, typ := range []pbfio.EntityType{pbfio.NodeType, pbfio.WayType, pbfio.RelationType} {
+		for _, id := range r.Perm(300) {
+			e := pbfio.Entity{Type: typ, ID: int64(id) - 100, Info: &pbfio.Info{Version: 1}}
+			if typ == pbfio.NodeType {
+				e.Lat, e.Lon = int64(id)*12301230, -int64(id)*45604560
+			}
+			entities = append(entities, e)
+		}
+	}
+	r.Shuffle(len(entities), func(i, j int) { entities[i], entities[j] = entities[j], entities[i] })
+	for i := range len(entities) {
+		e := entities[i]
+		e.Info = &pbfio.Info{Version: 2}
+		entities = append(entities, e)
+	}
+	var blobs []pbfio.DecodedBlob
+	for len(entities) > 0 {
+		// Node locations are multiples of 10, so the first block needs
+		// a finer granularity than the default.
+		builder := pbfio.BlockBuilder{Granularity: 10}
+		if len(blobs) > 0 {
+			builder.Granularity = 1000
+		}
+		n := min(len(entities), 50)
+		for i := range entities[:n] {
+			builder.Add(&entities[i])
+		}
+		entities = entities[n:]
+		blobs = append(blobs, pbfio.DecodedBlob{
+			BlobHeader:     &pbfproto.BlobHeader{Type: ptr("OSMData")},
+			PrimitiveBlock: builder.Build(),
+			Index:          len(blobs) + 1,
+		})
+	}
+	return blobs
+}
+
+func TestSortBlobs(t *testing.T) {
+	// A few hundred bytes force one run per input blob and several
+	// passes of merging runs.
+	locations := map[[2]int64][2]int64{}
+	for _, blob := range sortTestBlobs() {
+		entities, err := pbfio.Entities(blob.PrimitiveBlock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entities {
+			if e.Type == pbfio.NodeType {
+				locations[[2]int64{e.ID, int64(e.Info.Version)}] = [2]int64{e.Lat, e.Lon}
+			}
+		}
+	}
+	for _, test := range []struct {
+		sortMemory int
+		cluster    string
+	}{{1 << 30, ""}, {500, ""}, {1 << 30, "nodes"}, {500, "nodes"}} {
+		sortMemory := test.sortMemory
+		cfg := config{
+			cluster:     test.cluster,
+			sortMemory:  sortMemory,
+			maxBlobSize: 16 * 1024,
+			outFile:     filepath.Join(t.TempDir(), "out.osm.pbf"),
+		}
+		blobsIn := make(chan pbfio.DecodedBlob)
+		go func() {
+			for _, blob := range sortTestBlobs() {
+				blobsIn <- blob
+			}
+			close(blobsIn)
+		}()
+		blobsOut := make(chan pbfio.DecodedBlob)
+		done := make(chan error, 1)
+		go func() {
+			done <- sortBlobs(cfg, blobsIn, blobsOut, make(chan error), &outputStats{}, nil)
+			close(blobsOut)
+		}()
+		var got []pbfio.Entity
+		for blob := range blobsOut {
+			entities, err := pbfio.Entities(blob.PrimitiveBlock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, entities...)
+		}
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1800 {
+			t.Fatalf("got %d entities with sort memory %d, want 1800", len(got), sortMemory)
+		}
+		var prev sortEntity
+		for i, e := range got {
+			current := sortEntity{entity: e}
+			if test.cluster != "" {
+				current.key = clusterCell(&e, false)
+			}
+			if i > 0 && compareSortEntities(prev, current) > 0 {
+				t.Fatalf("entity %d (%s %d) is out of order with sort memory %d and cluster '%s'", i, e.Type, e.ID, sortMemory, test.cluster)
+			} else if want := int32(i%2 + 1); e.Info.Version != want {
+				t.Fatalf("entity %d (%s %d) has version %d, want %d with sort memory %d", i, e.Type, e.ID, e.Info.Version, want, sortMemory)
+			} else if e.Type == pbfio.NodeType && [2]int64{e.Lat, e.Lon} != locations[[2]int64{e.ID, int64(e.Info.Version)}] {
+				t.Fatalf("node %d has location %d,%d with sort memory %d", e.ID, e.Lat, e.Lon, sortMemory)
+			}
+			prev = current
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/codesoap/pbf-reblob/pbfproto"
+)
+
+func TestUpdateDenseUserSids(t *testing.T) {
+	oldStringtable := [][]byte{{}, []byte("a"), []byte("b")}
+	indexes := map[string]int{"": 0, "a": 5, "b": 7}
+	// The users are a, a, b, b, a.
+	nodes := &pbfproto.DenseNodes{
+		Id:        []int64{1, 1, 1, 1, 1},
+		Denseinfo: &pbfproto.DenseInfo{UserSid: []int32{1, 0, 1, 0, -1}},
+	}
+	updateDenseNodesStringIndexes(nodes, oldStringtable, indexes)
+	if want := []int32{5, 0, 2, 0, -2}; !slices.Equal(nodes.Denseinfo.UserSid, want) {
+		t.Errorf("got user SIDs %v, want %v", nodes.Denseinfo.UserSid, want)
+	}
+}
+
+func TestUpdateRelationRoles(t *testing.T) {
+	oldStringtable := [][]byte{{}, []byte("outer"), []byte("inner")}
+	indexes := map[string]int{"": 0, "outer": 4, "inner": 9}
+	rels := []*pbfproto.Relation{{RolesSid: []int32{1, 2, 1}}}
+	updateRelationsStringIndexes(rels, oldStringtable, indexes)
+	if want := []int32{4, 9, 4}; !slices.Equal(rels[0].RolesSid, want) {
+		t.Errorf("got roles %v, want %v", rels[0].RolesSid, want)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"github.com/codesoap/pbf-reblob/pbfio"
+	"github.com/codesoap/pbf-reblob/pbfproto"
+)
+
+// transformBlocks returns a channel, which receives the blobs of
+// blobsIn after their blocks have been passed to fn. fn reports whether
+// it changed the block. It is closed after blobsIn.
+func transformBlocks(blobsIn chan pbfio.DecodedBlob, fn func(*pbfproto.PrimitiveBlock) bool) chan pbfio.DecodedBlob {
+	blobsOut := make(chan pbfio.DecodedBlob)
+	go func() {
+		defer close(blobsOut)
+		for blob := range blobsIn {
+			if blob.Err == nil && blob.PrimitiveBlock != nil && fn(blob.PrimitiveBlock) {
+				blob.RawBlob = nil
+			}
+			blobsOut <- blob
+		}
+	}()
+	return blobsOut
+}
+
+// omitMetadata removes the metadata and the strings only used by it
+// from block.
+func omitMetadata(block *pbfproto.PrimitiveBlock) bool {
+	stripMetadata(block)
+	pruneStrings(block)
+	return true
+}
+
+// stripMetadata removes the Info and DenseInfo of all entities of block.
+// The user names stay in the string table until pruneStrings is called.
+func stripMetadata(block *pbfproto.PrimitiveBlock) {
+	for _, group := range block.Primitivegroup {
+		for _, node := range group.Nodes {
+			node.Info = nil
+		}
+		if group.Dense != nil {
+			group.Dense.Denseinfo = nil
+		}
+		for _, way := range group.Ways {
+			way.Info = nil
+		}
+		for _, rel := range group.Relations {
+			rel.Info = nil
+		}
+	}
+}
+
+// pruneStrings removes all strings from the string table of block, that
+// are not referenced by any entity, and updates the references. It
+// reports whether strings were removed. The first string is always
+// kept, because index 0 has special meanings.
+func pruneStrings(block *pbfproto.PrimitiveBlock) bool {
+	strings := block.Stringtable.S
+	used := make([]bool, len(strings))
+	if len(used) > 0 {
+		used[0] = true
+	}
+	mapStringRefs(block, func(sid int32) int32 {
+		if sid >= 0 && int(sid) < len(used) {
+			used[sid] = true
+		}
+		return sid
+	})
+	newIndexes := make([]int32, len(strings))
+	kept := strings[:0]
+	for i, s := range strings {
+		if used[i] {
+			newIndexes[i] = int32(len(kept))
+			kept = append(kept, s)
+		}
+	}
+	if len(kept) == len(strings) {
+		return false
+	}
+	block.Stringtable.S = kept
+	mapStringRefs(block, func(sid int32) int32 {
+		if sid < 0 || int(sid) >= len(newIndexes) {
+			return sid // Invalid references are left for the reader to detect.
+		}
+		return newIndexes[sid]
+	})
+	return true
+}
+
+// mapStringRefs replaces every string index in block with the result of
+// fn. The separators in DenseNodes.KeysVals are left unchanged.
+func mapStringRefs(block *pbfproto.PrimitiveBlock, fn func(sid int32) int32) {
+	mapInfo := func(info *pbfproto.Info) {
+		if info != nil && info.UserSid != nil {
+			sid := uint32(fn(int32(*info.UserSid)))
+			info.UserSid = &sid
+		}
+	}
+	mapTags := func(keys, vals []uint32) {
+		for i := range keys {
+			keys[i] = uint32(fn(int32(keys[i])))
+		}
+		for i := range vals {
+			vals[i] = uint32(fn(int32(vals[i])))
+		}
+	}
+	for _, group := range block.Primitivegroup {
+		for _, node := range group.Nodes {
+			mapTags(node.Keys, node.Vals)
+			mapInfo(node.Info)
+		}
+		if dense := group.Dense; dense != nil {
+			for i, sid := range dense.KeysVals {
+				if sid != 0 {
+					dense.KeysVals[i] = fn(sid)
+				}
+			}
+			if dense.Denseinfo != nil {
+				var sid, prevNewSID int32
+				for i, delta := range dense.Denseinfo.UserSid {
+					sid += delta
+					newSID := fn(sid)
+					dense.Denseinfo.UserSid[i] = newSID - prevNewSID
+					prevNewSID = newSID
+				}
+			}
+		}
+		for _, way := range group.Ways {
+			mapTags(way.Keys, way.Vals)
+			mapInfo(way.Info)
+		}
+		for _, rel := range group.Relations {
+			mapTags(rel.Keys, rel.Vals)
+			mapInfo(rel.Info)
+			for i := range rel.RolesSid {
+				rel.RolesSid[i] = fn(rel.RolesSid[i])
+			}
+		}
+	}
+}
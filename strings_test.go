@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/codesoap/pbf-reblob/pbfio"
+)
+
+func TestOmitMetadata(t *testing.T) {
+	entities := []pbfio.Entity{
+		{Type: pbfio.NodeType, ID: 1, Tags: []pbfio.Tag{{Key: "name", Value: "x"}},
+			Info: &pbfio.Info{Version: 1, User: "alice"}},
+		{Type: pbfio.NodeType, ID: 2, Info: &pbfio.Info{Version: 1, User: "bob"}},
+		{Type: pbfio.NodeType, ID: 3, Tags: []pbfio.Tag{{Key: "bob", Value: "y"}},
+			Info: &pbfio.Info{Version: 1, User: "carol"}},
+		{Type: pbfio.WayType, ID: 1, Refs: []int64{1, 2},
+			Info: &pbfio.Info{Version: 2, User: "dave"}},
+		{Type: pbfio.RelationType, ID: 1, Tags: []pbfio.Tag{{Key: "type", Value: "route"}},
+			Members: []pbfio.Member{{Type: pbfio.WayType, ID: 1, Role: "outer"}, {Type: pbfio.NodeType, ID: 3}},
+			Info:    &pbfio.Info{Version: 3, User: "erin"}},
+	}
+	var builder pbfio.BlockBuilder
+	for i := range entities {
+		builder.Add(&entities[i])
+	}
+	block := builder.Build()
+	stripMetadata(block)
+	if !pruneStrings(block) {
+		t.Fatal("no strings were pruned")
+	}
+	for _, user := range []string{"alice", "carol", "dave", "erin"} {
+		if slices.ContainsFunc(block.Stringtable.S, func(s []byte) bool { return string(s) == user }) {
+			t.Errorf("unused string '%s' was not pruned", user)
+		}
+	}
+	got, err := pbfio.Entities(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range entities {
+		entities[i].Info = nil
+	}
+	if !reflect.DeepEqual(got, entities) {
+		t.Errorf("got %+v, want %+v", got, entities)
+	}
+	if pruneStrings(block) {
+		t.Error("strings were pruned twice")
+	}
+}
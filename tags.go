@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/codesoap/pbf-reblob/pbfproto"
+)
+
+// tagFilter removes tags by their key. A tag is kept, if its key
+// matches one of the keep patterns, if there are any, and none of the
+// drop patterns. Patterns use the syntax of path.Match.
+type tagFilter struct {
+	keep, drop []string
+}
+
+func (f *tagFilter) register(flags *flag.FlagSet) {
+	flags.Func("drop-tags", "remove tags whose key matches one of these comma separated globs, e.g. 'note,fixme,source:*'",
+		patternsFlag(&f.drop))
+	flags.Func("keep-tags", "remove tags whose key matches none of these comma separated globs",
+		patternsFlag(&f.keep))
+}
+
+func patternsFlag(patterns *[]string) func(string) error {
+	return func(s string) error {
+		for _, pattern := range strings.Split(s, ",") {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern '%s': %v", pattern, err)
+			}
+			*patterns = append(*patterns, pattern)
+		}
+		return nil
+	}
+}
+
+func (f tagFilter) active() bool {
+	return len(f.keep) > 0 || len(f.drop) > 0
+}
+
+func (f tagFilter) keeps(key string) bool {
+	return (len(f.keep) == 0 || matchesAny(f.keep, key)) && !matchesAny(f.drop, key)
+}
+
+func matchesAny(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// apply removes the filtered tags and the strings only used by them from
+// block. It reports whether block was changed.
+func (f tagFilter) apply(block *pbfproto.PrimitiveBlock) bool {
+	if !f.filterBlock(block) {
+		return false
+	}
+	pruneStrings(block)
+	return true
+}
+
+// filterBlock removes the filtered tags from all entities of block. It
+// reports whether tags were removed.
+func (f tagFilter) filterBlock(block *pbfproto.PrimitiveBlock) bool {
+	strings := block.Stringtable.S
+	// Whether a key is kept is only decided once per string; 0 means
+	// undecided, 1 kept and 2 removed.
+	decisions := make([]uint8, len(strings))
+	keeps := func(sid uint32) bool {
+		if int(sid) >= len(decisions) {
+			return true // Invalid references are left for the reader to detect.
+		} else if decisions[sid] == 0 {
+			decisions[sid] = 2
+			if f.keeps(string(strings[sid])) {
+				decisions[sid] = 1
+			}
+		}
+		return decisions[sid] == 1
+	}
+	var changed bool
+	filter := func(keys, vals []uint32) ([]uint32, []uint32) {
+		n := 0
+		for i := range min(len(keys), len(vals)) {
+			if keeps(keys[i]) {
+				keys[n], vals[n] = keys[i], vals[i]
+				n++
+			}
+		}
+		if n < len(keys) || n < len(vals) {
+			changed = true
+		}
+		return keys[:n], vals[:n]
+	}
+	for _, group := range block.Primitivegroup {
+		for _, node := range group.Nodes {
+			node.Keys, node.Vals = filter(node.Keys, node.Vals)
+		}
+		if dense := group.Dense; dense != nil {
+			kv := dense.KeysVals[:0]
+			for i := 0; i < len(dense.KeysVals); i++ {
+				if key := dense.KeysVals[i]; key == 0 || i+1 == len(dense.KeysVals) {
+					kv = append(kv, key)
+				} else if keeps(uint32(key)) {
+					kv = append(kv, key, dense.KeysVals[i+1])
+					i++
+				} else {
+					changed = true
+					i++
+				}
+			}
+			dense.KeysVals = kv
+		}
+		for _, way := range group.Ways {
+			way.Keys, way.Vals = filter(way.Keys, way.Vals)
+		}
+		for _, rel := range group.Relations {
+			rel.Keys, rel.Vals = filter(rel.Keys, rel.Vals)
+		}
+	}
+	return changed
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/codesoap/pbf-reblob/pbfio"
+)
+
+func TestTagFilter(t *testing.T) {
+	tags := []pbfio.Tag{
+		{Key: "highway", Value: "residential"},
+		{Key: "note", Value: "x"},
+		{Key: "source:geometry", Value: "survey"},
+		{Key: "name", Value: "note"},
+	}
+	tests := []struct {
+		filter tagFilter
+		want   []pbfio.Tag
+	}{
+		{tagFilter{drop: []string{"note", "source:*"}}, []pbfio.Tag{tags[0], tags[3]}},
+		{tagFilter{keep: []string{"highway", "name*"}}, []pbfio.Tag{tags[0], tags[3]}},
+		{tagFilter{keep: []string{"*"}, drop: []string{"highway"}}, tags[1:]},
+		{tagFilter{keep: []string{"building"}}, nil},
+	}
+	for i, test := range tests {
+		entities := []pbfio.Entity{
+			{Type: pbfio.NodeType, ID: 1, Tags: tags},
+			{Type: pbfio.NodeType, ID: 2},
+			{Type: pbfio.NodeType, ID: 3, Tags: tags},
+			{Type: pbfio.WayType, ID: 1, Tags: tags, Refs: []int64{1, 3}},
+			{Type: pbfio.RelationType, ID: 1, Tags: tags},
+		}
+		var builder pbfio.BlockBuilder
+		for i := range entities {
+			builder.Add(&entities[i])
+		}
+		block := builder.Build()
+		if !test.filter.apply(block) {
+			t.Errorf("test %d: block was not changed", i)
+		}
+		got, err := pbfio.Entities(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, e := range got {
+			want := test.want
+			if entities[j].Tags == nil {
+				want = nil
+			}
+			if !slices.Equal(e.Tags, want) {
+				t.Errorf("test %d: got tags %v for %s %d, want %v", i, e.Tags, e.Type, e.ID, want)
+			}
+		}
+	}
+}